@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/satori/go.uuid"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+var accessLogOut io.Writer = os.Stdout
+var accessLogLock sync.Mutex
+
+func init() {
+	switch path := os.Getenv("ACCESS_LOG"); path {
+	case "":
+	case "off":
+		accessLogOut = nil
+	default:
+		var f, openErr = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if openErr != nil {
+			log.Panicln("Error while opening ACCESS_LOG", openErr)
+		}
+		accessLogOut = f
+	}
+}
+
+type accessEntry struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id"`
+	Method    string    `json:"method"`
+	VHost     string    `json:"vhost"`
+	Path      string    `json:"path"`
+	Service   string    `json:"service"`
+	APIKey    string    `json:"api_key"`
+	Scheme    string    `json:"scheme"`
+	Upstream  string    `json:"upstream,omitempty"`
+	Status    int       `json:"status"`
+	Bytes     int64     `json:"bytes"`
+	Latency   float64   `json:"latency"`
+	Remote    string    `json:"remote"`
+}
+
+// loggedURI is the request URI with the API key query parameter redacted,
+// as the log sees requests before KeyAuth takes the credential off.
+func loggedURI(u *url.URL) string {
+	var query = u.Query()
+	if _, found := query[apiKeyParam]; !found {
+		return u.RequestURI()
+	}
+	query.Set(apiKeyParam, "REDACTED")
+	var redacted = *u
+	redacted.RawQuery = query.Encode()
+	return redacted.RequestURI()
+}
+
+// AccessLog writes one JSON line per request and makes sure it carries an
+// X-Request-ID, generating one if the client did not send it. The ID is
+// passed upstream and echoed back in the response.
+func AccessLog(labels reqLabels, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var start = time.Now()
+		var reqID = r.Header.Get(requestIDHeader)
+		if reqID == "" {
+			reqID = uuid.NewV4().String()
+			r.Header.Set(requestIDHeader, reqID)
+		}
+		w.Header().Set(requestIDHeader, reqID)
+
+		if accessLogOut == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var upstream net.Conn
+		var trace = &httptrace.ClientTrace{
+			GotConn: func(info httptrace.GotConnInfo) {
+				upstream = info.Conn
+			},
+		}
+		var sw = &statusWriter{passWriter: passWriter{w}}
+		var entry = accessEntry{
+			Time:      start.UTC(),
+			RequestID: reqID,
+			Method:    r.Method,
+			VHost:     r.Host,
+			Path:      loggedURI(r.URL),
+			Service:   labels.Service,
+			APIKey:    labels.APIKey,
+			Scheme:    labels.Scheme,
+			Remote:    r.RemoteAddr,
+		}
+		// Written in a defer so requests the proxy aborts midway are logged too.
+		defer func() {
+			entry.Status = sw.Status()
+			entry.Bytes = sw.bytes
+			entry.Latency = time.Since(start).Seconds()
+			if upstream != nil {
+				// Skynet streams only learn their remote end once the dial has been
+				// answered, so the address is read after the response.
+				entry.Upstream = upstream.RemoteAddr().String()
+			}
+			var line, _ = json.Marshal(entry)
+			accessLogLock.Lock()
+			accessLogOut.Write(append(line, '\n'))
+			accessLogLock.Unlock()
+		}()
+		next.ServeHTTP(sw, r.WithContext(httptrace.WithClientTrace(r.Context(), trace)))
+	})
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ACME_DIRECTORY enables certificate provisioning for every vhost from the
+// given RFC 8555 directory URL. ACME_CA trusts an extra root for talking to
+// the directory, which is what a local Pebble needs.
+var acmeDirectory = os.Getenv("ACME_DIRECTORY")
+var acmeEmail = os.Getenv("ACME_EMAIL")
+var acmeCA = os.Getenv("ACME_CA")
+
+var acmeRenewBefore = time.Hour * 24 * 30
+
+const acmeChallengePath = "/.well-known/acme-challenge/"
+
+// acmeKick asks the provisioning loop to look at the vhost table again.
+var acmeKick = make(chan struct{}, 1)
+
+var acmeTokens = struct {
+	sync.RWMutex
+	m map[string]string
+}{m: map[string]string{}}
+
+type acmeClient struct {
+	http *http.Client
+	key  *ecdsa.PrivateKey
+	kid  string
+	dir  struct {
+		NewNonce   string `json:"newNonce"`
+		NewAccount string `json:"newAccount"`
+		NewOrder   string `json:"newOrder"`
+	}
+
+	nonceLock sync.Mutex
+	nonces    []string
+}
+
+type acmeProblem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+}
+
+type acmeOrder struct {
+	Status         string   `json:"status"`
+	Authorizations []string `json:"authorizations"`
+	Finalize       string   `json:"finalize"`
+	Certificate    string   `json:"certificate"`
+}
+
+type acmeAuthz struct {
+	Status     string `json:"status"`
+	Challenges []struct {
+		Type  string `json:"type"`
+		URL   string `json:"url"`
+		Token string `json:"token"`
+	} `json:"challenges"`
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func pad32(i *big.Int) []byte {
+	var b = make([]byte, 32)
+	var ib = i.Bytes()
+	copy(b[32-len(ib):], ib)
+	return b
+}
+
+func (self *acmeClient) jwk() map[string]string {
+	return map[string]string{
+		"crv": "P-256",
+		"kty": "EC",
+		"x":   b64(pad32(self.key.X)),
+		"y":   b64(pad32(self.key.Y)),
+	}
+}
+
+// thumbprint is the RFC 7638 thumbprint of the account key.
+func (self *acmeClient) thumbprint() string {
+	var jwk = self.jwk()
+	var canon = fmt.Sprintf(`{"crv":"P-256","kty":"EC","x":"%s","y":"%s"}`, jwk["x"], jwk["y"])
+	var sum = sha256.Sum256([]byte(canon))
+	return b64(sum[:])
+}
+
+func (self *acmeClient) saveNonce(resp *http.Response) {
+	if n := resp.Header.Get("Replay-Nonce"); n != "" {
+		self.nonceLock.Lock()
+		self.nonces = append(self.nonces, n)
+		self.nonceLock.Unlock()
+	}
+}
+
+func (self *acmeClient) nonce() (string, error) {
+	self.nonceLock.Lock()
+	if len(self.nonces) > 0 {
+		var n = self.nonces[len(self.nonces)-1]
+		self.nonces = self.nonces[:len(self.nonces)-1]
+		self.nonceLock.Unlock()
+		return n, nil
+	}
+	self.nonceLock.Unlock()
+
+	var resp, headErr = self.http.Head(self.dir.NewNonce)
+	if headErr != nil {
+		return "", headErr
+	}
+	resp.Body.Close()
+	if n := resp.Header.Get("Replay-Nonce"); n != "" {
+		return n, nil
+	}
+	return "", fmt.Errorf("acme: no nonce from %s", self.dir.NewNonce)
+}
+
+// post sends a JWS signed request. A nil payload makes it a POST-as-GET.
+func (self *acmeClient) post(url string, payload interface{}, out interface{}) (*http.Response, []byte, error) {
+	var payloadB64 string
+	if payload != nil {
+		var pb, encErr = json.Marshal(payload)
+		if encErr != nil {
+			return nil, nil, encErr
+		}
+		payloadB64 = b64(pb)
+	}
+
+	for attempt := 0; ; attempt++ {
+		var nonce, nonceErr = self.nonce()
+		if nonceErr != nil {
+			return nil, nil, nonceErr
+		}
+		var protected = map[string]interface{}{"alg": "ES256", "nonce": nonce, "url": url}
+		if self.kid == "" {
+			protected["jwk"] = self.jwk()
+		} else {
+			protected["kid"] = self.kid
+		}
+		var pb, _ = json.Marshal(protected)
+		var protectedB64 = b64(pb)
+		var hash = sha256.Sum256([]byte(protectedB64 + "." + payloadB64))
+		var r, s, signErr = ecdsa.Sign(rand.Reader, self.key, hash[:])
+		if signErr != nil {
+			return nil, nil, signErr
+		}
+		var body, _ = json.Marshal(map[string]string{
+			"protected": protectedB64,
+			"payload":   payloadB64,
+			"signature": b64(append(pad32(r), pad32(s)...)),
+		})
+
+		var resp, postErr = self.http.Post(url, "application/jose+json", bytes.NewReader(body))
+		if postErr != nil {
+			return nil, nil, postErr
+		}
+		self.saveNonce(resp)
+		var respBody, readErr = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if readErr != nil {
+			return nil, nil, readErr
+		}
+		if resp.StatusCode >= 400 {
+			var prob acmeProblem
+			json.Unmarshal(respBody, &prob)
+			if prob.Type == "urn:ietf:params:acme:error:badNonce" && attempt < 3 {
+				continue
+			}
+			return resp, respBody, fmt.Errorf("acme: %s %s: %s", url, prob.Type, prob.Detail)
+		}
+		if out != nil {
+			if decErr := json.Unmarshal(respBody, out); decErr != nil {
+				return resp, respBody, decErr
+			}
+		}
+		return resp, respBody, nil
+	}
+}
+
+func loadAccountKey(path string) (*ecdsa.PrivateKey, error) {
+	if data, readErr := ioutil.ReadFile(path); readErr == nil {
+		var block, _ = pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("acme: no PEM data in %s", path)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	var key, genErr = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if genErr != nil {
+		return nil, genErr
+	}
+	var der, _ = x509.MarshalECPrivateKey(key)
+	var data = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	return key, ioutil.WriteFile(path, data, 0600)
+}
+
+func newACMEClient() (*acmeClient, error) {
+	var self = &acmeClient{http: &http.Client{Timeout: time.Second * 30}}
+	if acmeCA != "" {
+		var pemCA, readErr = ioutil.ReadFile(acmeCA)
+		if readErr != nil {
+			return nil, readErr
+		}
+		var pool, poolErr = x509.SystemCertPool()
+		if poolErr != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pemCA) {
+			return nil, fmt.Errorf("acme: no certificates in %s", acmeCA)
+		}
+		self.http.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	}
+
+	var keyErr error
+	self.key, keyErr = loadAccountKey(filepath.Join(certDir, "acme-account.pem"))
+	if keyErr != nil {
+		return nil, keyErr
+	}
+
+	var resp, dirErr = self.http.Get(acmeDirectory)
+	if dirErr != nil {
+		return nil, dirErr
+	}
+	defer resp.Body.Close()
+	if decErr := json.NewDecoder(resp.Body).Decode(&self.dir); decErr != nil {
+		return nil, decErr
+	}
+
+	var account = map[string]interface{}{"termsOfServiceAgreed": true}
+	if acmeEmail != "" {
+		account["contact"] = []string{"mailto:" + acmeEmail}
+	}
+	var accResp, _, accErr = self.post(self.dir.NewAccount, account, nil)
+	if accErr != nil {
+		return nil, accErr
+	}
+	self.kid = accResp.Header.Get("Location")
+	return self, nil
+}
+
+// poll re-fetches url into out until it leaves the pending/processing states.
+func (self *acmeClient) poll(url string, out interface{}, status func() string) error {
+	for i := 0; i < 60; i++ {
+		switch status() {
+		case "valid", "ready":
+			return nil
+		case "invalid", "revoked", "deactivated", "expired":
+			return fmt.Errorf("acme: %s is %s", url, status())
+		}
+		time.Sleep(time.Second)
+		if _, _, pollErr := self.post(url, nil, out); pollErr != nil {
+			return pollErr
+		}
+	}
+	return fmt.Errorf("acme: timeout waiting for %s", url)
+}
+
+func (self *acmeClient) authorize(authzURL string) error {
+	var authz acmeAuthz
+	if _, _, authzErr := self.post(authzURL, nil, &authz); authzErr != nil {
+		return authzErr
+	}
+	if authz.Status == "valid" {
+		return nil
+	}
+	for _, ch := range authz.Challenges {
+		if ch.Type != "http-01" {
+			continue
+		}
+		acmeTokens.Lock()
+		acmeTokens.m[ch.Token] = ch.Token + "." + self.thumbprint()
+		acmeTokens.Unlock()
+		defer func() {
+			acmeTokens.Lock()
+			delete(acmeTokens.m, ch.Token)
+			acmeTokens.Unlock()
+		}()
+
+		if _, _, chErr := self.post(ch.URL, struct{}{}, nil); chErr != nil {
+			return chErr
+		}
+		return self.poll(authzURL, &authz, func() string { return authz.Status })
+	}
+	return fmt.Errorf("acme: no http-01 challenge offered for %s", authzURL)
+}
+
+// obtain gets a certificate for name and stores it in certDir next to the
+// manually managed ones as acme-<name>.crt/.key.
+func (self *acmeClient) obtain(name string) error {
+	var order acmeOrder
+	var orderResp, _, orderErr = self.post(self.dir.NewOrder, map[string]interface{}{
+		"identifiers": []map[string]string{{"type": "dns", "value": name}},
+	}, &order)
+	if orderErr != nil {
+		return orderErr
+	}
+	var orderURL = orderResp.Header.Get("Location")
+
+	for _, authzURL := range order.Authorizations {
+		if authzErr := self.authorize(authzURL); authzErr != nil {
+			return authzErr
+		}
+	}
+
+	var certKey, genErr = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if genErr != nil {
+		return genErr
+	}
+	var csr, csrErr = x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: name},
+		DNSNames: []string{name},
+	}, certKey)
+	if csrErr != nil {
+		return csrErr
+	}
+	if pollErr := self.poll(orderURL, &order, func() string { return order.Status }); pollErr != nil {
+		return pollErr
+	}
+	if _, _, finErr := self.post(order.Finalize, map[string]string{"csr": b64(csr)}, &order); finErr != nil {
+		return finErr
+	}
+	if pollErr := self.poll(orderURL, &order, func() string {
+		if order.Status == "valid" && order.Certificate == "" {
+			return "processing"
+		}
+		return order.Status
+	}); pollErr != nil {
+		return pollErr
+	}
+	var _, chain, certErr = self.post(order.Certificate, nil, nil)
+	if certErr != nil {
+		return certErr
+	}
+
+	var der, _ = x509.MarshalECPrivateKey(certKey)
+	var base = filepath.Join(certDir, "acme-"+name)
+	return writeKeyPair(base, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), chain)
+}
+
+// writeKeyPair stores a key and its certificate chain as base.key/.crt. Both
+// are written to temporary files first and the .crt is renamed last, so the
+// certificate watcher never pairs a new .crt with a missing or stale key.
+func writeKeyPair(base string, keyPEM, chain []byte) error {
+	if writeErr := ioutil.WriteFile(base+".key.tmp", keyPEM, 0600); writeErr != nil {
+		return writeErr
+	}
+	if writeErr := ioutil.WriteFile(base+".crt.tmp", chain, 0644); writeErr != nil {
+		os.Remove(base + ".key.tmp")
+		return writeErr
+	}
+	if renameErr := os.Rename(base+".key.tmp", base+".key"); renameErr != nil {
+		os.Remove(base + ".key.tmp")
+		os.Remove(base + ".crt.tmp")
+		return renameErr
+	}
+	return os.Rename(base+".crt.tmp", base+".crt")
+}
+
+// needsCert reports whether name has no usable certificate yet or the one it
+// has expires within acmeRenewBefore.
+func needsCert(name string) bool {
+	var cert = certs.lookup(name)
+	return cert == nil || cert.Leaf == nil || cert.Leaf.NotAfter.Sub(time.Now()) < acmeRenewBefore
+}
+
+// acmeLoop keeps a certificate for every vhost in the HostSwitch, checking on
+// every reload and twice a day for renewals.
+func acmeLoop() {
+	var client *acmeClient
+	for {
+		if client == nil {
+			var clientErr error
+			if client, clientErr = newACMEClient(); clientErr != nil {
+				log.Println("ACME account setup failed:", clientErr)
+				client = nil
+				time.Sleep(time.Minute)
+				continue
+			}
+		}
+
+		// Certificates are stored and looked up by the lowercased name.
+		var wanted = map[string]bool{}
+		for vHost := range currentRouter().VHosts {
+			if name := strings.ToLower(vHost); !strings.ContainsAny(name, "*~") && needsCert(name) {
+				wanted[name] = true
+			}
+		}
+		var names []string
+		for name := range wanted {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		var issued = false
+		for _, name := range names {
+			if obtainErr := client.obtain(name); obtainErr != nil {
+				log.Println("ACME certificate for", name, "failed:", obtainErr)
+				continue
+			}
+			log.Println("ACME certificate issued for", name)
+			issued = true
+		}
+		if issued {
+			if loadErr := certs.load(certDir); loadErr != nil {
+				log.Println("Certificate reload failed, keeping previous ones:", loadErr)
+			}
+		}
+
+		select {
+		case <-acmeKick:
+		case <-time.After(time.Hour * 12):
+		}
+	}
+}
+
+// ACMEChallenge answers http-01 challenges on the public HTTP listener.
+func ACMEChallenge(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, acmeChallengePath) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		acmeTokens.RLock()
+		var keyAuth, found = acmeTokens.m[strings.TrimPrefix(r.URL.Path, acmeChallengePath)]
+		acmeTokens.RUnlock()
+		if !found {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(keyAuth))
+	})
+}
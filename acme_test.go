@@ -0,0 +1,270 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// acmeStub is a minimal RFC 8555 server issuing certificates from a test CA
+// for a single http-01 challenge. It verifies the JWS of every request and
+// checks the key authorization served by ACMEChallenge.
+type acmeStub struct {
+	t     *testing.T
+	url   string
+	ca    *x509.Certificate
+	caKey *ecdsa.PrivateKey
+
+	sync.Mutex
+	nonce      int
+	nonces     map[string]bool
+	badNonce   bool
+	accountKey *ecdsa.PublicKey
+	authzValid bool
+	orderState string
+	certDER    []byte
+}
+
+func (self *acmeStub) newNonce(w http.ResponseWriter) {
+	self.nonce++
+	var n = fmt.Sprintf("nonce-%d", self.nonce)
+	self.nonces[n] = true
+	w.Header().Set("Replay-Nonce", n)
+}
+
+func (self *acmeStub) problem(w http.ResponseWriter, code int, typ, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(acmeProblem{"urn:ietf:params:acme:error:" + typ, detail})
+}
+
+// verify checks the JWS of a request and returns its decoded payload, nil for
+// a POST-as-GET.
+func (self *acmeStub) verify(r *http.Request) ([]byte, error) {
+	var jws struct{ Protected, Payload, Signature string }
+	if decErr := json.NewDecoder(r.Body).Decode(&jws); decErr != nil {
+		return nil, decErr
+	}
+	var protectedJSON, _ = base64.RawURLEncoding.DecodeString(jws.Protected)
+	var protected struct {
+		Alg, Nonce, URL, Kid string
+		JWK                  map[string]string
+	}
+	if decErr := json.Unmarshal(protectedJSON, &protected); decErr != nil {
+		return nil, decErr
+	}
+	if protected.Alg != "ES256" || protected.URL != self.url+r.URL.Path {
+		return nil, fmt.Errorf("bad protected header %s", protectedJSON)
+	}
+	if !self.nonces[protected.Nonce] {
+		return nil, fmt.Errorf("unknown nonce %q", protected.Nonce)
+	}
+	delete(self.nonces, protected.Nonce)
+
+	var key = self.accountKey
+	if protected.JWK != nil {
+		var x, _ = base64.RawURLEncoding.DecodeString(protected.JWK["x"])
+		var y, _ = base64.RawURLEncoding.DecodeString(protected.JWK["y"])
+		key = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	} else if protected.Kid != self.url+"/account/1" || key == nil {
+		return nil, fmt.Errorf("unknown account %q", protected.Kid)
+	}
+	var sig, _ = base64.RawURLEncoding.DecodeString(jws.Signature)
+	var hash = sha256.Sum256([]byte(jws.Protected + "." + jws.Payload))
+	if len(sig) != 64 || !ecdsa.Verify(key, hash[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+		return nil, fmt.Errorf("bad signature")
+	}
+	if protected.JWK != nil {
+		self.accountKey = key
+	}
+	if jws.Payload == "" {
+		return nil, nil
+	}
+	return base64.RawURLEncoding.DecodeString(jws.Payload)
+}
+
+func (self *acmeStub) order() map[string]interface{} {
+	var order = map[string]interface{}{
+		"status":         self.orderState,
+		"authorizations": []string{self.url + "/authz/1"},
+		"finalize":       self.url + "/finalize/1",
+	}
+	if self.orderState == "valid" {
+		order["certificate"] = self.url + "/cert/1"
+	}
+	return order
+}
+
+func (self *acmeStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	self.Lock()
+	defer self.Unlock()
+
+	if r.URL.Path == "/directory" {
+		json.NewEncoder(w).Encode(map[string]string{
+			"newNonce":   self.url + "/new-nonce",
+			"newAccount": self.url + "/new-account",
+			"newOrder":   self.url + "/new-order",
+		})
+		return
+	}
+	self.newNonce(w)
+	if r.URL.Path == "/new-nonce" {
+		return
+	}
+	if r.URL.Path == "/new-account" && self.badNonce {
+		// Make the client retry with a fresh nonce once.
+		self.badNonce = false
+		self.problem(w, http.StatusBadRequest, "badNonce", "stale nonce")
+		return
+	}
+	var payload, verifyErr = self.verify(r)
+	if verifyErr != nil {
+		self.t.Errorf("%s: %s", r.URL.Path, verifyErr)
+		self.problem(w, http.StatusBadRequest, "malformed", verifyErr.Error())
+		return
+	}
+
+	switch r.URL.Path {
+	case "/new-account":
+		w.Header().Set("Location", self.url+"/account/1")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]string{"status": "valid"})
+	case "/new-order":
+		self.orderState = "pending"
+		w.Header().Set("Location", self.url+"/order/1")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(self.order())
+	case "/order/1":
+		json.NewEncoder(w).Encode(self.order())
+	case "/authz/1":
+		var status = "pending"
+		if self.authzValid {
+			status = "valid"
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": status,
+			"challenges": []map[string]string{
+				{"type": "dns-01", "url": self.url + "/chall/dns", "token": "dns-token"},
+				{"type": "http-01", "url": self.url + "/chall/1", "token": "http-token"},
+			},
+		})
+	case "/chall/1":
+		// Fetch the key authorization the way the CA would.
+		var rec = httptest.NewRecorder()
+		ACMEChallenge(http.NotFoundHandler()).ServeHTTP(rec, httptest.NewRequest("GET", acmeChallengePath+"http-token", nil))
+		var jwk = fmt.Sprintf(`{"crv":"P-256","kty":"EC","x":"%s","y":"%s"}`,
+			b64(pad32(self.accountKey.X)), b64(pad32(self.accountKey.Y)))
+		var sum = sha256.Sum256([]byte(jwk))
+		if want := "http-token." + b64(sum[:]); rec.Code != http.StatusOK || rec.Body.String() != want {
+			self.t.Errorf("challenge answered %d %q, want %q", rec.Code, rec.Body.String(), want)
+			self.problem(w, http.StatusForbidden, "unauthorized", "bad key authorization")
+			return
+		}
+		self.authzValid, self.orderState = true, "ready"
+		json.NewEncoder(w).Encode(map[string]string{"status": "valid"})
+	case "/finalize/1":
+		var req struct{ CSR string }
+		json.Unmarshal(payload, &req)
+		var der, _ = base64.RawURLEncoding.DecodeString(req.CSR)
+		var csr, csrErr = x509.ParseCertificateRequest(der)
+		if csrErr != nil || self.orderState != "ready" {
+			self.problem(w, http.StatusForbidden, "orderNotReady", fmt.Sprint(csrErr))
+			return
+		}
+		var tmpl = &x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			Subject:      csr.Subject,
+			DNSNames:     csr.DNSNames,
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour * 24 * 90),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}
+		var certDER, certErr = x509.CreateCertificate(rand.Reader, tmpl, self.ca, csr.PublicKey, self.caKey)
+		if certErr != nil {
+			self.t.Error(certErr)
+		}
+		self.certDER = certDER
+		self.orderState = "valid"
+		json.NewEncoder(w).Encode(self.order())
+	case "/cert/1":
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: self.certDER})
+		pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: self.ca.Raw})
+	default:
+		self.problem(w, http.StatusNotFound, "malformed", "unknown resource")
+	}
+}
+
+func TestACMEObtain(t *testing.T) {
+	var caDir, caDirErr = ioutil.TempDir("", "acme_ca")
+	if caDirErr != nil {
+		t.Fatal(caDirErr)
+	}
+	defer os.RemoveAll(caDir)
+	var dir, dirErr = ioutil.TempDir("", "acme_certs")
+	if dirErr != nil {
+		t.Fatal(dirErr)
+	}
+	defer os.RemoveAll(dir)
+
+	var stub = &acmeStub{t: t, nonces: map[string]bool{}, badNonce: true}
+	stub.ca, stub.caKey, _, _ = testCert(t, caDir, "ca", nil, nil)
+	var srv = httptest.NewServer(stub)
+	defer srv.Close()
+	stub.url = srv.URL
+
+	var prevDirectory, prevCertDir = acmeDirectory, certDir
+	acmeDirectory, certDir = srv.URL+"/directory", dir
+	defer func() { acmeDirectory, certDir = prevDirectory, prevCertDir }()
+
+	var client, clientErr = newACMEClient()
+	if clientErr != nil {
+		t.Fatal(clientErr)
+	}
+	if client.kid != srv.URL+"/account/1" {
+		t.Errorf("account %q", client.kid)
+	}
+	if obtainErr := client.obtain("api.partner.test"); obtainErr != nil {
+		t.Fatal(obtainErr)
+	}
+
+	var tmps, _ = filepath.Glob(filepath.Join(dir, "*.tmp"))
+	if len(tmps) != 0 {
+		t.Errorf("temporary files left: %v", tmps)
+	}
+	var base = filepath.Join(dir, "acme-api.partner.test")
+	var pair, pairErr = tls.LoadX509KeyPair(base+".crt", base+".key")
+	if pairErr != nil {
+		t.Fatal(pairErr)
+	}
+	if len(pair.Certificate) != 2 {
+		t.Errorf("got a chain of %d certificates, want 2", len(pair.Certificate))
+	}
+	var leaf, _ = x509.ParseCertificate(pair.Certificate[0])
+	if leaf == nil || leaf.VerifyHostname("api.partner.test") != nil {
+		t.Errorf("certificate not issued for api.partner.test")
+	}
+
+	acmeTokens.RLock()
+	defer acmeTokens.RUnlock()
+	if len(acmeTokens.m) != 0 {
+		t.Errorf("challenge tokens left: %v", acmeTokens.m)
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/zenhotels/astranet/addr"
+	"github.com/zenhotels/astranet/transport"
+)
+
+// adminMux serves the admin listener on ADMIN_PORT.
+var adminMux = http.NewServeMux()
+
+var adminToken = os.Getenv("ADMIN_TOKEN")
+var adminAllow []*net.IPNet
+
+func init() {
+	for _, a := range strings.Split(os.Getenv("ADMIN_ALLOW"), ",") {
+		if a = strings.TrimSpace(a); a == "" {
+			continue
+		}
+		if !strings.Contains(a, "/") {
+			if strings.Contains(a, ":") {
+				a += "/128"
+			} else {
+				a += "/32"
+			}
+		}
+		var _, ipNet, cidrErr = net.ParseCIDR(a)
+		if cidrErr != nil {
+			log.Panicln("Error while ADMIN_ALLOW parsing", cidrErr)
+		}
+		adminAllow = append(adminAllow, ipNet)
+	}
+
+	// Importing net/http/pprof registers it on http.DefaultServeMux, which
+	// astranet serves without any auth on the ipc.<host> binding of every
+	// node. Profiles are only served on adminMux.
+	http.DefaultServeMux = http.NewServeMux()
+
+	adminMux.HandleFunc("/healthz", Healthz)
+	adminMux.HandleFunc("/readyz", Readyz)
+	adminMux.HandleFunc("/metrics", Metrics)
+	adminMux.HandleFunc("/debug/pprof/", pprof.Index)
+	adminMux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	adminMux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	adminMux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	adminMux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	adminMux.HandleFunc("/api/v1/services", APIServices)
+	adminMux.HandleFunc("/api/v1/keys", APIKeys)
+	adminMux.HandleFunc("/api/v1/vhosts", APIVHosts)
+	adminMux.HandleFunc("/api/v1/breakers", APIBreakers)
+	adminMux.HandleFunc("/api/v1/skynet/services", APISkynetServices)
+	adminMux.HandleFunc("/api/v1/skynet/routes", APISkynetRoutes)
+	adminMux.HandleFunc("/api/v1/skynet/seeds", APISkynetSeeds)
+}
+
+// vhostInfo describes one route of the HostSwitch table.
+type vhostInfo struct {
+	VHost   string `json:"vhost"`
+	Path    string `json:"path,omitempty"`
+	Service string `json:"service"`
+	Handler string `json:"handler"`
+	APIKey  string `json:"api_key"`
+}
+
+type serviceView struct {
+	Name      string   `json:"name"`
+	Upstream  string   `json:"upstream"`
+	Scheme    string   `json:"scheme"`
+	Timeout   string   `json:"timeout"`
+	VHosts    []string `json:"vhosts"`
+	Directors []string `json:"directors"`
+	Split     string   `json:"split,omitempty"`
+}
+
+type keyView struct {
+	Name   string            `json:"name"`
+	ID     string            `json:"id"`
+	Tokens int               `json:"tokens"`
+	Stage  map[string]string `json:"stage"`
+}
+
+type skynetServiceView struct {
+	Service  string `json:"service"`
+	Host     string `json:"host"`
+	Port     uint32 `json:"port"`
+	Priority int    `json:"priority"`
+	Upstream string `json:"upstream"`
+}
+
+type skynetRouteView struct {
+	Host     string `json:"host"`
+	Distance int    `json:"distance"`
+	Upstream string `json:"upstream"`
+}
+
+// AdminAuth guards the admin listener with the ADMIN_ALLOW address list and
+// the ADMIN_TOKEN bearer token, whichever are set. Health checks stay open so
+// load balancers can probe them. With neither set, only health checks and
+// metrics are served: profiles and the API expose too much to go unguarded.
+func AdminAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" || r.URL.Path == "/readyz" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(adminAllow) == 0 && adminToken == "" && r.URL.Path != "/metrics" {
+			http.Error(w, "Forbidden, set ADMIN_TOKEN or ADMIN_ALLOW to enable", http.StatusForbidden)
+			return
+		}
+		if len(adminAllow) > 0 {
+			var host, _, _ = net.SplitHostPort(r.RemoteAddr)
+			var ip = net.ParseIP(host)
+			var allowed = false
+			for _, ipNet := range adminAllow {
+				allowed = allowed || ip != nil && ipNet.Contains(ip)
+			}
+			if !allowed {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+		}
+		if adminToken != "" {
+			var token = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	var enc = json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func upstreamAddr(u transport.Transport) string {
+	if u == nil || u.RAddr() == nil {
+		return ""
+	}
+	return u.RAddr().String()
+}
+
+// APIServices lists configured services, optionally only ?service=<name>.
+func APIServices(w http.ResponseWriter, r *http.Request) {
+	var filter = r.URL.Query().Get("service")
+	var rt = currentRouter()
+	var res = []serviceView{}
+	for srvName, srvConf := range rt.Services {
+		if filter != "" && filter != srvName {
+			continue
+		}
+		var upstreams = make([]string, len(srvConf.Upstreams))
+		for i, u := range srvConf.Upstreams {
+			upstreams[i] = u.String()
+		}
+		var directors = []string{}
+		for _, d := range srvConf.Directors {
+			directors = append(directors, d.String())
+		}
+		res = append(res, serviceView{
+			Name:      srvName,
+			Upstream:  strings.Join(upstreams, ","),
+			Scheme:    srvConf.Upstream.Scheme,
+			Timeout:   srvConf.DialTimeout.String(),
+			VHosts:    srvConf.VHost,
+			Directors: directors,
+			Split:     srvConf.Split.String(),
+		})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	writeJSON(w, res)
+}
+
+// APIKeys lists API keys with their stage overrides. Tokens are only counted.
+func APIKeys(w http.ResponseWriter, r *http.Request) {
+	var filter = r.URL.Query().Get("service")
+	var rt = currentRouter()
+	var res = []keyView{}
+	for keyName, key := range rt.APIKeys {
+		var stage = map[string]string{}
+		for srvName, override := range key.VSrvMap {
+			if filter == "" || filter == srvName || filter == override {
+				stage[srvName] = override
+			}
+		}
+		for srvName, arms := range key.Splits {
+			if filter == "" || filter == srvName || strings.Contains(","+arms.String(), ","+filter+"=") {
+				stage[srvName] = arms.String()
+			}
+		}
+		if filter != "" && len(stage) == 0 {
+			continue
+		}
+		res = append(res, keyView{
+			Name:   keyName,
+			ID:     key.ID,
+			Tokens: len(key.Tokens),
+			Stage:  stage,
+		})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	writeJSON(w, res)
+}
+
+// APIVHosts dumps the HostSwitch table of the current generation.
+func APIVHosts(w http.ResponseWriter, r *http.Request) {
+	var filter = r.URL.Query().Get("service")
+	var rt = currentRouter()
+	var res = []vhostInfo{}
+	for _, vis := range rt.VHosts {
+		for _, vi := range vis {
+			if filter != "" && filter != vi.Service && filter != vi.Handler {
+				continue
+			}
+			res = append(res, vi)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].VHost != res[j].VHost {
+			return res[i].VHost < res[j].VHost
+		}
+		return res[i].Path < res[j].Path
+	})
+	writeJSON(w, res)
+}
+
+// APISkynetServices lists services currently discoverable in skynet.
+func APISkynetServices(w http.ResponseWriter, r *http.Request) {
+	var filter = r.URL.Query().Get("service")
+	var res = []skynetServiceView{}
+	for _, srv := range skynet.Services() {
+		if filter != "" && filter != srv.Service {
+			continue
+		}
+		res = append(res, skynetServiceView{
+			Service:  srv.Service,
+			Host:     addr.Uint2Host(srv.Host),
+			Port:     srv.Port,
+			Priority: srv.Priority,
+			Upstream: upstreamAddr(srv.Upstream),
+		})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Service != res[j].Service {
+			return res[i].Service < res[j].Service
+		}
+		return res[i].Host < res[j].Host
+	})
+	writeJSON(w, res)
+}
+
+// APISkynetRoutes lists the routes to other skynet nodes, optionally only to
+// the nodes serving ?service=<name>.
+func APISkynetRoutes(w http.ResponseWriter, r *http.Request) {
+	var filter = r.URL.Query().Get("service")
+	var hosts = map[uint64]bool{}
+	for _, srv := range skynet.Services() {
+		if srv.Service == filter {
+			hosts[srv.Host] = true
+		}
+	}
+	var res = []skynetRouteView{}
+	for _, rt := range skynet.Routes() {
+		if filter != "" && !hosts[rt.Host] {
+			continue
+		}
+		res = append(res, skynetRouteView{
+			Host:     addr.Uint2Host(rt.Host),
+			Distance: rt.Distance,
+			Upstream: upstreamAddr(rt.Upstream),
+		})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Host < res[j].Host })
+	writeJSON(w, res)
+}
+
+// APISkynetSeeds reports the link state of every configured seed peer.
+func APISkynetSeeds(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, seedStatuses())
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+)
+
+const (
+	apiKeyHeader  = "X-Api-Key"
+	apiKeyParam   = "api_key"
+	apiNameHeader = "X-Api-Key-Name"
+)
+
+type ctxKey int
+
+const (
+	ctxAPIKey ctxKey = iota
+	ctxSkynet
+	ctxRetry
+	ctxBreaker
+	ctxTimeout
+	ctxHost
+	ctxShed
+)
+
+// APIKeyName returns the name of the API key the request was accepted for.
+func APIKeyName(req *http.Request) string {
+	var name, _ = req.Context().Value(ctxAPIKey).(string)
+	return name
+}
+
+// presentedToken takes the API key token off the request, looking at the
+// X-Api-Key header, the api_key query parameter and basic auth in that order.
+// The credential is removed so it is never forwarded upstream.
+func presentedToken(req *http.Request) string {
+	if token := req.Header.Get(apiKeyHeader); token != "" {
+		req.Header.Del(apiKeyHeader)
+		return token
+	}
+	if query := req.URL.Query(); query.Get(apiKeyParam) != "" {
+		var token = query.Get(apiKeyParam)
+		query.Del(apiKeyParam)
+		req.URL.RawQuery = query.Encode()
+		return token
+	}
+	if user, pass, ok := req.BasicAuth(); ok {
+		req.Header.Del("Authorization")
+		if pass != "" {
+			return pass
+		}
+		return user
+	}
+	return ""
+}
+
+// findToken looks the token up in tokens without leaking the match position
+// through timing.
+func findToken(tokens map[string]string, token string) string {
+	var found string
+	for t, keyName := range tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			found = keyName
+		}
+	}
+	return found
+}
+
+// KeyAuth attaches the identity of keyName to requests served on its vhosts.
+// If the key has tokens, the request must present one of them: a missing or
+// unknown token gets 401, a token of another key gets 403. Keys without
+// tokens, like "common", are selected by vhost alone as before. The key name is
+// forwarded upstream in X-Api-Key-Name, replacing anything the client sent.
+func KeyAuth(keyName string, key keyConf, tokens map[string]string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Del(apiNameHeader)
+		if len(key.Tokens) > 0 {
+			var owner = findToken(tokens, presentedToken(r))
+			switch {
+			case owner == "":
+				w.Header().Set("WWW-Authenticate", `Basic realm="api"`)
+				http.Error(w, "Invalid or missing API key", http.StatusUnauthorized)
+				return
+			case owner != keyName:
+				http.Error(w, "API key not allowed on this host", http.StatusForbidden)
+				return
+			}
+		}
+		r.Header.Set(apiNameHeader, keyName)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ctxAPIKey, keyName)))
+	})
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// balanceConf spreads the requests of an http service over its upstreams.
+// Method is roundrobin, leastconn or weighted. Upstream hostnames are looked
+// up again every Resolve, and an address is ejected for EjectTime after
+// Eject consecutive dial failures; a negative Eject never ejects.
+type balanceConf struct {
+	Method    string
+	Resolve   time.Duration
+	Eject     int
+	EjectTime time.Duration
+}
+
+var balanceMethods = map[string]bool{"roundrobin": true, "leastconn": true, "weighted": true}
+
+// upstreamTarget is one upstream URL of a service with the weight given in
+// its "weight" query parameter.
+type upstreamTarget struct {
+	host   string
+	weight int
+}
+
+func upstreamTargets(upstreams []*url.URL) ([]upstreamTarget, error) {
+	var res = make([]upstreamTarget, 0, len(upstreams))
+	for _, u := range upstreams {
+		var weight = 1
+		if w := u.Query().Get("weight"); w != "" {
+			var parsed, wErr = strconv.Atoi(w)
+			if wErr != nil || parsed < 1 {
+				return nil, fmt.Errorf("bad weight %q of %s", w, u.Host)
+			}
+			weight = parsed
+		}
+		res = append(res, upstreamTarget{u.Host, weight})
+	}
+	return res, nil
+}
+
+// endpoint is a resolved address of an upstream target.
+type endpoint struct {
+	addr     string
+	host     string
+	weight   int
+	current  int
+	active   int64
+	failures int
+	ejected  time.Time
+}
+
+type balancer struct {
+	sync.Mutex
+	service   string
+	conf      balanceConf
+	port      string
+	targets   []upstreamTarget
+	endpoints []*endpoint
+	resolved  time.Time
+	resolving bool
+	next      int
+}
+
+// resolve looks the upstream hostnames up, keeping the state of the addresses
+// that did not change and the previous addresses of a lookup that failed.
+func (self *balancer) resolve() {
+	self.Lock()
+	var known = map[string]*endpoint{}
+	for _, ep := range self.endpoints {
+		known[ep.host+"/"+ep.addr] = ep
+	}
+	self.Unlock()
+
+	var endpoints []*endpoint
+	for _, t := range self.targets {
+		var host, port, hpErr = net.SplitHostPort(t.host)
+		if hpErr != nil {
+			host, port = t.host, self.port
+		}
+		var addrs = []string{host}
+		if net.ParseIP(host) == nil {
+			var lookedUp, lookupErr = net.LookupHost(host)
+			if lookupErr != nil {
+				log.Println("Error while resolving upstream", t.host, "of", self.service, lookupErr)
+				for _, ep := range known {
+					if ep.host == t.host {
+						endpoints = append(endpoints, ep)
+					}
+				}
+				continue
+			}
+			addrs = lookedUp
+		}
+		for _, a := range addrs {
+			var ep = known[t.host+"/"+net.JoinHostPort(a, port)]
+			if ep == nil {
+				ep = &endpoint{addr: net.JoinHostPort(a, port), host: t.host, weight: t.weight}
+			}
+			endpoints = append(endpoints, ep)
+		}
+	}
+
+	self.Lock()
+	self.endpoints = endpoints
+	self.resolved = time.Now()
+	self.resolving = false
+	self.Unlock()
+}
+
+// serverName is the hostname of the upstream addr was resolved from.
+func (self *balancer) serverName(addr string) string {
+	self.Lock()
+	defer self.Unlock()
+	for _, ep := range self.endpoints {
+		if ep.addr == addr {
+			if host, _, hpErr := net.SplitHostPort(ep.host); hpErr == nil {
+				return host
+			}
+			return ep.host
+		}
+	}
+	var host, _, _ = net.SplitHostPort(addr)
+	return host
+}
+
+// refresh resolves the upstreams before the first request and in the
+// background once the previous lookup is older than Resolve.
+func (self *balancer) refresh(now time.Time) {
+	self.Lock()
+	if self.resolved.IsZero() {
+		self.Unlock()
+		self.resolve()
+		return
+	}
+	var stale = self.conf.Resolve > 0 && now.Sub(self.resolved) > self.conf.Resolve && !self.resolving
+	if stale {
+		self.resolving = true
+	}
+	self.Unlock()
+	if stale {
+		go self.resolve()
+	}
+}
+
+// pick chooses an address not in exclude and not ejected, falling back to
+// the excluded ones and then to the ejected ones when nothing else is left.
+func (self *balancer) pick(exclude string, now time.Time) *endpoint {
+	self.Lock()
+	defer self.Unlock()
+	var live, fresh []*endpoint
+	for _, ep := range self.endpoints {
+		if now.Before(ep.ejected) {
+			continue
+		}
+		live = append(live, ep)
+		if !strings.Contains(exclude, ","+ep.addr+",") {
+			fresh = append(fresh, ep)
+		}
+	}
+	var pool = fresh
+	if len(pool) == 0 {
+		pool = live
+	}
+	if len(pool) == 0 {
+		pool = self.endpoints
+	}
+	if len(pool) == 0 {
+		return nil
+	}
+
+	var best *endpoint
+	switch self.conf.Method {
+	case "leastconn":
+		self.next++
+		for i := range pool {
+			var ep = pool[(self.next+i)%len(pool)]
+			if best == nil || atomic.LoadInt64(&ep.active) < atomic.LoadInt64(&best.active) {
+				best = ep
+			}
+		}
+	case "weighted":
+		// Smooth weighted round-robin, as in nginx.
+		var total = 0
+		for _, ep := range pool {
+			ep.current += ep.weight
+			total += ep.weight
+			if best == nil || ep.current > best.current {
+				best = ep
+			}
+		}
+		best.current -= total
+	default:
+		self.next++
+		best = pool[self.next%len(pool)]
+	}
+	atomic.AddInt64(&best.active, 1)
+	return best
+}
+
+// record ejects an address after Eject dial failures in a row.
+func (self *balancer) record(ep *endpoint, err error, now time.Time) {
+	self.Lock()
+	defer self.Unlock()
+	if opErr, ok := err.(*net.OpError); !ok || opErr.Op != "dial" {
+		ep.failures = 0
+		return
+	}
+	ep.failures++
+	if self.conf.Eject > 0 && ep.failures >= self.conf.Eject {
+		ep.failures = 0
+		ep.ejected = now.Add(self.conf.EjectTime)
+		log.Println("Ejected upstream", ep.addr, "of", self.service, "for", self.conf.EjectTime)
+	}
+}
+
+func (self *balancer) done(ep *endpoint) {
+	atomic.AddInt64(&ep.active, -1)
+}
+
+// releaseBody releases the address of a response once its body is closed.
+type releaseBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (self *releaseBody) Close() error {
+	var err = self.ReadCloser.Close()
+	self.once.Do(self.release)
+	return err
+}
+
+// balancerTransport sends each request of an http service to the address the
+// balancer picks, the one the Director set unless a director changed it.
+// Connections are pooled per address.
+type balancerTransport struct {
+	balancer *balancer
+	upstream string
+	next     *http.Transport
+}
+
+func (self balancerTransport) CloseIdleConnections() {
+	self.next.CloseIdleConnections()
+}
+
+func (self balancerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host != self.upstream {
+		return self.next.RoundTrip(req)
+	}
+	var now = time.Now()
+	self.balancer.refresh(now)
+	var state, _ = req.Context().Value(ctxRetry).(*retryState)
+	var exclude = ""
+	if state != nil {
+		exclude = state.exclude()
+	}
+	var ep = self.balancer.pick(exclude, now)
+	if ep == nil {
+		return nil, &net.AddrError{Err: "No upstream address", Addr: self.upstream}
+	}
+	if state != nil {
+		state.add(ep.addr)
+	}
+
+	var out = new(http.Request)
+	*out = *req
+	var u = *req.URL
+	u.Host = ep.addr
+	out.URL = &u
+	if out.Host == self.upstream {
+		out.Host = ep.host
+	}
+	var resp, err = self.next.RoundTrip(out)
+	self.balancer.record(ep, err, time.Now())
+	if err != nil {
+		self.balancer.done(ep)
+		return nil, err
+	}
+	resp.Body = &releaseBody{ReadCloser: resp.Body, release: func() { self.balancer.done(ep) }}
+	return resp, nil
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/zenhotels/astranet/addr"
+)
+
+// breakerConf trips a circuit after Failures consecutive failures or once
+// ErrorRate of the requests in the current breakerWindow failed. An open
+// circuit sheds requests for Cooldown, then lets a single probe through.
+// The same settings apply to the service, which sees the outcome after
+// retries, and to each of its hosts, which see every try.
+type breakerConf struct {
+	Failures  int
+	ErrorRate float64
+	Cooldown  time.Duration
+}
+
+func (self breakerConf) enabled() bool {
+	return self.Failures > 0 || self.ErrorRate > 0
+}
+
+var breakerWindow = time.Second * 10
+var breakerMinRequests = 20
+
+const (
+	circuitClosed = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+var circuitStates = []string{"closed", "open", "half-open"}
+
+type breaker struct {
+	sync.Mutex
+	service     string
+	host        string
+	state       int
+	since       time.Time
+	consecutive int
+	window      time.Time
+	total       int
+	failed      int
+	probing     bool
+}
+
+// blocked reports whether a request would be shed, without claiming the
+// half-open probe.
+func (self *breaker) blocked(c breakerConf, now time.Time) bool {
+	self.Lock()
+	defer self.Unlock()
+	switch self.state {
+	case circuitOpen:
+		return now.Sub(self.since) < c.Cooldown
+	case circuitHalfOpen:
+		return self.probing
+	}
+	return false
+}
+
+func (self *breaker) allow(c breakerConf, now time.Time) bool {
+	self.Lock()
+	defer self.Unlock()
+	switch self.state {
+	case circuitOpen:
+		if now.Sub(self.since) < c.Cooldown {
+			return false
+		}
+		self.set(circuitHalfOpen, now)
+		self.probing = true
+		return true
+	case circuitHalfOpen:
+		if self.probing {
+			return false
+		}
+		self.probing = true
+	}
+	return true
+}
+
+func (self *breaker) record(c breakerConf, ok bool, now time.Time) {
+	self.Lock()
+	defer self.Unlock()
+	switch self.state {
+	case circuitHalfOpen:
+		self.probing = false
+		if ok {
+			self.set(circuitClosed, now)
+			log.Println("Circuit closed for", self.name())
+		} else {
+			self.trip(now)
+		}
+	case circuitClosed:
+		if now.Sub(self.window) > breakerWindow {
+			self.window, self.total, self.failed = now, 0, 0
+		}
+		self.total++
+		if ok {
+			self.consecutive = 0
+			return
+		}
+		self.failed++
+		self.consecutive++
+		if c.Failures > 0 && self.consecutive >= c.Failures ||
+			c.ErrorRate > 0 && self.total >= breakerMinRequests &&
+				float64(self.failed)/float64(self.total) >= c.ErrorRate {
+			self.trip(now)
+		}
+	}
+}
+
+func (self *breaker) set(state int, now time.Time) {
+	self.state, self.since = state, now
+	self.consecutive, self.window, self.total, self.failed = 0, now, 0, 0
+}
+
+func (self *breaker) trip(now time.Time) {
+	self.set(circuitOpen, now)
+	log.Println("Circuit opened for", self.name())
+	metrics.GetOrRegisterCounter("api_endpoint_circuit_trips_total{"+self.labels()+"}", metricsRegistry).Inc(1)
+}
+
+func (self *breaker) name() string {
+	if self.host == "" {
+		return self.service
+	}
+	return self.service + " on " + self.host
+}
+
+func (self *breaker) labels() string {
+	return `service=` + strconv.Quote(self.service) + `,host=` + strconv.Quote(self.host)
+}
+
+// serviceBreaker holds the circuit of a service and of each skynet host
+// serving it. They outlive reloads so a config change does not reset them.
+type serviceBreaker struct {
+	breaker
+	hostsLock sync.Mutex
+	hosts     map[uint64]*breaker
+}
+
+var breakers = struct {
+	sync.Mutex
+	m map[string]*serviceBreaker
+}{m: map[string]*serviceBreaker{}}
+
+func getBreaker(srvName string) *serviceBreaker {
+	breakers.Lock()
+	defer breakers.Unlock()
+	var b = breakers.m[srvName]
+	if b == nil {
+		b = &serviceBreaker{hosts: map[uint64]*breaker{}}
+		b.service = srvName
+		breakers.m[srvName] = b
+	}
+	return b
+}
+
+func (self *serviceBreaker) host(host uint64) *breaker {
+	self.hostsLock.Lock()
+	defer self.hostsLock.Unlock()
+	var b = self.hosts[host]
+	if b == nil {
+		b = &breaker{service: self.service, host: addr.Uint2Host(host)}
+		self.hosts[host] = b
+	}
+	return b
+}
+
+// blockedHosts lists the hosts with a shedding circuit in the format of
+// excludeSelector.
+func (self *serviceBreaker) blockedHosts(c breakerConf) string {
+	var now = time.Now()
+	var res = ""
+	self.hostsLock.Lock()
+	defer self.hostsLock.Unlock()
+	for host, b := range self.hosts {
+		if b.blocked(c, now) {
+			res += "," + hostKey(host) + ","
+		}
+	}
+	return res
+}
+
+// failedStatus tells responses that count against a circuit: the gateway
+// errors a dead or overloaded upstream produces, not application errors.
+func failedStatus(status int) bool {
+	switch status {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+var errCircuitOpen = errors.New("circuit open for every upstream host")
+
+// allOpen travels in the request context and tells whether the last try found
+// the circuit of every host open.
+type allOpen struct {
+	flag int32
+}
+
+func (self *allOpen) set(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&self.flag, v)
+}
+
+func (self *allOpen) isSet() bool {
+	return atomic.LoadInt32(&self.flag) == 1
+}
+
+// shedWriter answers 503 Service Unavailable instead of the proxy's 502 when
+// the last try found the circuit of every host open.
+type shedWriter struct {
+	passWriter
+	flag       *allOpen
+	retryAfter string
+}
+
+func (self *shedWriter) WriteHeader(code int) {
+	if code == http.StatusBadGateway && self.flag.isSet() {
+		self.Header().Set("Retry-After", self.retryAfter)
+		code = http.StatusServiceUnavailable
+	}
+	self.ResponseWriter.WriteHeader(code)
+}
+
+// CircuitBreaker sheds requests to srvName with 503 while its circuit is
+// open, and while the circuits of all its hosts are.
+func CircuitBreaker(srvName string, c breakerConf, next http.Handler) http.Handler {
+	if !c.enabled() {
+		return next
+	}
+	var b = getBreaker(srvName)
+	var retryAfter = strconv.Itoa(int(c.Cooldown.Seconds() + 0.5))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !b.allow(c, time.Now()) {
+			metrics.GetOrRegisterCounter("api_endpoint_circuit_rejected_total{"+b.labels()+"}", metricsRegistry).Inc(1)
+			w.Header().Set("Retry-After", retryAfter)
+			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		// Set by hostBreakerTransport when the last try found every host open.
+		var shed = &allOpen{}
+		var sw = &statusWriter{passWriter: passWriter{w}}
+		defer func() {
+			// The proxy aborts with a panic once the response was cut short.
+			// The outcome is recorded all the same, or a half-open circuit
+			// would wait for its probe forever; a client going away is not
+			// held against the upstream.
+			if p := recover(); p != nil {
+				b.record(c, r.Context().Err() == context.Canceled, time.Now())
+				panic(p)
+			}
+			b.record(c, !failedStatus(sw.Status()), time.Now())
+		}()
+		next.ServeHTTP(&shedWriter{passWriter{sw}, shed, retryAfter}, r.WithContext(context.WithValue(r.Context(), ctxShed, shed)))
+	})
+}
+
+// hostTry is filled in by pickInstance with the circuit of the host a try
+// was sent to.
+type hostTry struct {
+	service *serviceBreaker
+	conf    breakerConf
+	host    *breaker
+}
+
+// hostBreakerTransport keeps the circuit of every host a service is tried on.
+// It sits under retryTransport so each try counts.
+type hostBreakerTransport struct {
+	service *serviceBreaker
+	conf    breakerConf
+	next    http.RoundTripper
+}
+
+func (self hostBreakerTransport) CloseIdleConnections() {
+	if c, ok := self.next.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
+
+func (self hostBreakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var try = &hostTry{service: self.service, conf: self.conf}
+	var resp, err = self.next.RoundTrip(req.WithContext(context.WithValue(req.Context(), ctxBreaker, try)))
+	if shed, ok := req.Context().Value(ctxShed).(*allOpen); ok {
+		shed.set(err == errCircuitOpen)
+	}
+	if try.host != nil {
+		try.host.record(self.conf, err == nil && !failedStatus(resp.StatusCode), time.Now())
+	}
+	return resp, err
+}
+
+type breakerView struct {
+	Service  string    `json:"service"`
+	Host     string    `json:"host,omitempty"`
+	State    string    `json:"state"`
+	Since    time.Time `json:"since"`
+	Requests int       `json:"requests"`
+	Failures int       `json:"failures"`
+}
+
+func (self *breaker) view() breakerView {
+	self.Lock()
+	defer self.Unlock()
+	return breakerView{self.service, self.host, circuitStates[self.state], self.since, self.total, self.failed}
+}
+
+func breakerViews(filter string) []breakerView {
+	var res = []breakerView{}
+	breakers.Lock()
+	defer breakers.Unlock()
+	for srvName, b := range breakers.m {
+		if filter != "" && filter != srvName {
+			continue
+		}
+		res = append(res, b.view())
+		b.hostsLock.Lock()
+		for _, hb := range b.hosts {
+			res = append(res, hb.view())
+		}
+		b.hostsLock.Unlock()
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Service != res[j].Service {
+			return res[i].Service < res[j].Service
+		}
+		return res[i].Host < res[j].Host
+	})
+	return res
+}
+
+// APIBreakers reports the circuit of every service and host seen so far.
+func APIBreakers(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, breakerViews(r.URL.Query().Get("service")))
+}
@@ -0,0 +1,899 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var configPath = flag.String("config", envOr("CONFIG_FILE", ""), "JSON file with services and API keys")
+
+var srvRe = regexp.MustCompilePOSIX("SRV_([A-Z0-9_]*)_([A-Z0-9_]*)=(.*)")
+var keyRe = regexp.MustCompilePOSIX("KEY_([A-Z0-9_]*)_([A-Z0-9_]*)=(.*)")
+var stageRe = regexp.MustCompilePOSIX("STAGE_([A-Z0-9_]*)_([A-Z0-9_]*)=(.*)")
+
+// fileService mirrors the SRV_<NAME>_<PARAM> variables.
+type fileService struct {
+	Upstream    string              `json:"upstream"`
+	Timeout     string              `json:"timeout"`
+	Host        []string            `json:"host"`
+	Path        []string            `json:"path"`
+	StripPath   bool                `json:"strip_path"`
+	RewritePath string              `json:"rewrite_path"`
+	TLSRedirect bool                `json:"tls_redirect"`
+	HSTS        string              `json:"hsts"`
+	Retries     int                 `json:"retries"`
+	TryTimeout  string              `json:"try_timeout"`
+	Backoff     string              `json:"retry_backoff"`
+	RetryBody   bool                `json:"retry_body"`
+	Failures    int                 `json:"breaker_failures"`
+	ErrorRate   float64             `json:"breaker_error_rate"`
+	Cooldown    string              `json:"breaker_cooldown"`
+	Request     string              `json:"request_timeout"`
+	Header      string              `json:"response_header_timeout"`
+	Idle        string              `json:"idle_timeout"`
+	MaxDuration string              `json:"max_duration"`
+	MaxIdle     int                 `json:"max_idle"`
+	PoolIdle    string              `json:"pool_idle_timeout"`
+	Directors   []map[string]string `json:"directors"`
+	Balance     string              `json:"balance"`
+	Resolve     string              `json:"resolve_interval"`
+	Eject       int                 `json:"eject_failures"`
+	EjectTime   string              `json:"eject_time"`
+	CA          string              `json:"tls_ca"`
+	ServerName  string              `json:"tls_server_name"`
+	Cert        string              `json:"tls_cert"`
+	Key         string              `json:"tls_key"`
+	MinTLS      string              `json:"tls_min_version"`
+	Split       string              `json:"split"`
+	SplitBy     string              `json:"split_by"`
+	fileLimits
+}
+
+// fileKey mirrors the KEY_<NAME>_<PARAM> and STAGE_<NAME>_<SRV> variables.
+type fileKey struct {
+	ID     string            `json:"id"`
+	Tokens []string          `json:"tokens"`
+	Stage  map[string]string `json:"stage"`
+	fileLimits
+}
+
+// fileLimits mirrors the RATE, BURST, DAILY and MONTHLY parameters shared by
+// services and keys.
+type fileLimits struct {
+	Rate    float64 `json:"rate"`
+	Burst   int64   `json:"burst"`
+	Daily   int64   `json:"daily"`
+	Monthly int64   `json:"monthly"`
+}
+
+func (self fileLimits) apply(l *limitConf) {
+	if self.Rate != 0 {
+		l.Rate = self.Rate
+	}
+	if self.Burst != 0 {
+		l.Burst = self.Burst
+	}
+	if self.Daily != 0 {
+		l.Daily = self.Daily
+	}
+	if self.Monthly != 0 {
+		l.Monthly = self.Monthly
+	}
+}
+
+// setLimit applies a RATE, BURST, DAILY or MONTHLY variable, reporting false
+// for any other param.
+func setLimit(l *limitConf, param, value string) (bool, error) {
+	var err error
+	switch param {
+	case "RATE":
+		l.Rate, err = strconv.ParseFloat(value, 64)
+	case "BURST":
+		l.Burst, err = strconv.ParseInt(value, 10, 64)
+	case "DAILY":
+		l.Daily, err = strconv.ParseInt(value, 10, 64)
+	case "MONTHLY":
+		l.Monthly, err = strconv.ParseInt(value, 10, 64)
+	default:
+		return false, nil
+	}
+	return true, err
+}
+
+type fileConf struct {
+	Services map[string]fileService `json:"services"`
+	Keys     map[string]fileKey     `json:"keys"`
+}
+
+type ConfigError struct {
+	File string
+	Line int
+	Msg  string
+}
+
+func (self ConfigError) Error() string {
+	if self.Line == 0 {
+		return fmt.Sprintf("%s: %s", self.File, self.Msg)
+	}
+	return fmt.Sprintf("%s:%d: %s", self.File, self.Line, self.Msg)
+}
+
+func envOr(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+// jsonKey is an object key of a JSON document: the keys and array indexes
+// leading to it and the line it is on.
+type jsonKey struct {
+	path []string
+	line int
+}
+
+// jsonKeys lists the object keys of data in document order, tracking where
+// each one is from the offsets of the decoder tokens.
+func jsonKeys(data []byte) []jsonKey {
+	type frame struct {
+		object  bool
+		wantKey bool
+		key     string
+		index   int
+	}
+	var stack []*frame
+	var keys []jsonKey
+	var path = func() []string {
+		var res = make([]string, len(stack))
+		for i, f := range stack {
+			if f.object {
+				res[i] = f.key
+			} else {
+				res[i] = strconv.Itoa(f.index)
+			}
+		}
+		return res
+	}
+	// valueDone moves the innermost container past the value just read.
+	var valueDone = func() {
+		if len(stack) == 0 {
+			return
+		}
+		if top := stack[len(stack)-1]; top.object {
+			top.wantKey = true
+		} else {
+			top.index++
+		}
+	}
+
+	var dec = json.NewDecoder(bytes.NewReader(data))
+	for {
+		var tok, tokErr = dec.Token()
+		if tokErr != nil {
+			return keys
+		}
+		if len(stack) > 0 && stack[len(stack)-1].wantKey {
+			var top = stack[len(stack)-1]
+			if key, isKey := tok.(string); isKey {
+				top.key, top.wantKey = key, false
+				keys = append(keys, jsonKey{path(), offsetLine(data, dec.InputOffset())})
+				continue
+			}
+		}
+		switch tok {
+		case json.Delim('{'):
+			stack = append(stack, &frame{object: true, wantKey: true})
+		case json.Delim('['):
+			stack = append(stack, &frame{})
+		case json.Delim('}'), json.Delim(']'):
+			stack = stack[:len(stack)-1]
+			valueDone()
+		default:
+			valueDone()
+		}
+	}
+}
+
+// lineOf finds the line of the JSON object key reached by following path
+// from the top of data. Zero means the key was not found.
+func lineOf(data []byte, path ...string) int {
+	var want = strings.Join(path, "\x00")
+	for _, key := range jsonKeys(data) {
+		if strings.Join(key.path, "\x00") == want {
+			return key.line
+		}
+	}
+	return 0
+}
+
+// unknownFieldLine finds the line of the first key of data that has no
+// field in t to decode into, as rejected by DisallowUnknownFields.
+func unknownFieldLine(data []byte, t reflect.Type) int {
+	for _, key := range jsonKeys(data) {
+		if !knownField(t, key.path) {
+			return key.line
+		}
+	}
+	return 0
+}
+
+func knownField(t reflect.Type, path []string) bool {
+	for _, name := range path {
+		for t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		switch t.Kind() {
+		case reflect.Map, reflect.Slice, reflect.Array:
+			t = t.Elem()
+		case reflect.Struct:
+			var field, found = jsonField(t, name)
+			if !found {
+				return false
+			}
+			t = field
+		default:
+			return true
+		}
+	}
+	return true
+}
+
+// jsonField finds the type of the field encoding/json decodes the key name
+// into, looking into embedded structs and ignoring case as it does.
+func jsonField(t reflect.Type, name string) (reflect.Type, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		var f = t.Field(i)
+		var tag = strings.Split(f.Tag.Get("json"), ",")[0]
+		if f.Anonymous && tag == "" && f.Type.Kind() == reflect.Struct {
+			if ft, found := jsonField(f.Type, name); found {
+				return ft, true
+			}
+			continue
+		}
+		if tag == "-" || f.PkgPath != "" {
+			continue
+		}
+		if tag == "" {
+			tag = f.Name
+		}
+		if strings.EqualFold(tag, name) {
+			return f.Type, true
+		}
+	}
+	return nil, false
+}
+
+func offsetLine(data []byte, offset int64) int {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	return bytes.Count(data[:offset], []byte("\n")) + 1
+}
+
+func parseUpstream(value string) (*url.URL, error) {
+	var upstream, upErr = url.Parse(value)
+	if upErr != nil {
+		return nil, upErr
+	}
+	if upstream.Scheme == "" {
+		upstream.Scheme = "shttp"
+	}
+	return upstream, nil
+}
+
+// parseUpstreams reads a comma separated list of upstream URLs; only http
+// services may list more than one.
+func parseUpstreams(value string) ([]*url.URL, error) {
+	var res []*url.URL
+	for _, part := range strings.Split(value, ",") {
+		var upstream, upErr = parseUpstream(strings.TrimSpace(part))
+		if upErr != nil {
+			return nil, upErr
+		}
+		res = append(res, upstream)
+	}
+	return res, nil
+}
+
+func readConfigFile(path string, env []string, services map[string]reverseConf, apiKeys map[string]keyConf) error {
+	var data, readErr = ioutil.ReadFile(path)
+	if readErr != nil {
+		return readErr
+	}
+
+	var fc fileConf
+	var dec = json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if decErr := dec.Decode(&fc); decErr != nil {
+		switch e := decErr.(type) {
+		case *json.SyntaxError:
+			return ConfigError{path, offsetLine(data, e.Offset), e.Error()}
+		case *json.UnmarshalTypeError:
+			return ConfigError{path, offsetLine(data, e.Offset), e.Error()}
+		}
+		if strings.HasPrefix(decErr.Error(), "json: unknown field ") {
+			return ConfigError{path, unknownFieldLine(data, reflect.TypeOf(fc)), decErr.Error()}
+		}
+		return ConfigError{path, 0, decErr.Error()}
+	}
+
+	for srvName, fs := range fc.Services {
+		var srv = services[srvName]
+		if fs.Upstream != "" {
+			var upstreams, upErr = parseUpstreams(fs.Upstream)
+			if upErr != nil {
+				return ConfigError{path, lineOf(data, "services", srvName, "upstream"), upErr.Error()}
+			}
+			srv.Upstream, srv.Upstreams = upstreams[0], upstreams
+		}
+		if fs.Timeout != "" {
+			var duration, dParseErr = time.ParseDuration(fs.Timeout)
+			if dParseErr != nil {
+				return ConfigError{path, lineOf(data, "services", srvName, "timeout"), dParseErr.Error()}
+			}
+			srv.DialTimeout = duration
+		}
+		if len(fs.Host) > 0 {
+			srv.VHost = fs.Host
+		}
+		if len(fs.Path) > 0 {
+			srv.Paths = fs.Path
+		}
+		if fs.StripPath {
+			srv.StripPath = true
+		}
+		if fs.RewritePath != "" {
+			srv.RewritePath = fs.RewritePath
+		}
+		if fs.TLSRedirect {
+			srv.TLSRedirect = true
+		}
+		if fs.HSTS != "" {
+			var duration, dParseErr = time.ParseDuration(fs.HSTS)
+			if dParseErr != nil {
+				return ConfigError{path, lineOf(data, "services", srvName, "hsts"), dParseErr.Error()}
+			}
+			srv.HSTS = duration
+		}
+		if fs.Retries != 0 {
+			srv.Retry.Retries = fs.Retries
+		}
+		if fs.TryTimeout != "" {
+			var duration, dParseErr = time.ParseDuration(fs.TryTimeout)
+			if dParseErr != nil {
+				return ConfigError{path, lineOf(data, "services", srvName, "try_timeout"), dParseErr.Error()}
+			}
+			srv.Retry.TryTimeout = duration
+		}
+		if fs.Backoff != "" {
+			var duration, dParseErr = time.ParseDuration(fs.Backoff)
+			if dParseErr != nil {
+				return ConfigError{path, lineOf(data, "services", srvName, "retry_backoff"), dParseErr.Error()}
+			}
+			srv.Retry.Backoff = duration
+		}
+		if fs.RetryBody {
+			srv.Retry.Body = true
+		}
+		if fs.Failures != 0 {
+			srv.Breaker.Failures = fs.Failures
+		}
+		if fs.ErrorRate != 0 {
+			srv.Breaker.ErrorRate = fs.ErrorRate
+		}
+		if fs.Cooldown != "" {
+			var duration, dParseErr = time.ParseDuration(fs.Cooldown)
+			if dParseErr != nil {
+				return ConfigError{path, lineOf(data, "services", srvName, "breaker_cooldown"), dParseErr.Error()}
+			}
+			srv.Breaker.Cooldown = duration
+		}
+		for _, d := range []struct {
+			key   string
+			value string
+			to    *time.Duration
+		}{
+			{"request_timeout", fs.Request, &srv.Timeouts.Request},
+			{"response_header_timeout", fs.Header, &srv.Timeouts.ResponseHeader},
+			{"idle_timeout", fs.Idle, &srv.Timeouts.Idle},
+			{"max_duration", fs.MaxDuration, &srv.Timeouts.MaxDuration},
+			{"pool_idle_timeout", fs.PoolIdle, &srv.Pool.IdleTimeout},
+			{"resolve_interval", fs.Resolve, &srv.Balance.Resolve},
+			{"eject_time", fs.EjectTime, &srv.Balance.EjectTime},
+		} {
+			if d.value == "" {
+				continue
+			}
+			var duration, dParseErr = time.ParseDuration(d.value)
+			if dParseErr != nil {
+				return ConfigError{path, lineOf(data, "services", srvName, d.key), dParseErr.Error()}
+			}
+			*d.to = duration
+		}
+		if fs.MaxIdle != 0 {
+			srv.Pool.MaxIdle = fs.MaxIdle
+		}
+		for _, v := range []struct {
+			value string
+			to    *string
+		}{
+			{fs.CA, &srv.TLS.CA},
+			{fs.ServerName, &srv.TLS.ServerName},
+			{fs.Cert, &srv.TLS.Cert},
+			{fs.Key, &srv.TLS.Key},
+			{fs.MinTLS, &srv.TLS.MinVersion},
+		} {
+			if v.value != "" {
+				*v.to = v.value
+			}
+		}
+		if fs.Split != "" {
+			var arms, sParseErr = parseSplit(fs.Split)
+			if sParseErr != nil {
+				return ConfigError{path, lineOf(data, "services", srvName, "split"), sParseErr.Error()}
+			}
+			srv.Split = arms
+		}
+		if fs.SplitBy != "" {
+			srv.SplitBy = fs.SplitBy
+		}
+		if fs.Balance != "" {
+			srv.Balance.Method = fs.Balance
+		}
+		if fs.Eject != 0 {
+			srv.Balance.Eject = fs.Eject
+		}
+		if fs.Directors != nil {
+			srv.Directors = []directorSpec{}
+			for _, d := range fs.Directors {
+				var spec = directorSpec{Name: d["name"], Params: map[string]string{}}
+				for k, v := range d {
+					if k != "name" {
+						spec.Params[k] = v
+					}
+				}
+				srv.Directors = append(srv.Directors, spec)
+			}
+		}
+		fs.fileLimits.apply(&srv.Limits)
+		services[srvName] = srv
+	}
+
+	for keyName, fk := range fc.Keys {
+		var key = apiKeys[keyName]
+		if fk.ID != "" {
+			key.ID = fk.ID
+		}
+		if len(fk.Tokens) > 0 {
+			key.Tokens = fk.Tokens
+		}
+		fk.fileLimits.apply(&key.Limits)
+		for srvName, override := range fk.Stage {
+			if stageErr := key.stage(srvName, override); stageErr != nil {
+				return ConfigError{path, lineOf(data, "keys", keyName, "stage", srvName), stageErr.Error()}
+			}
+			var targets = []string{override}
+			if arms, found := key.Splits[srvName]; found {
+				targets = targets[:0]
+				for _, arm := range arms {
+					targets = append(targets, arm.Service)
+				}
+			}
+			for _, target := range targets {
+				if _, found := fc.Services[target]; !found && !envHasService(env, target) {
+					return ConfigError{
+						path, lineOf(data, "keys", keyName, "stage", srvName),
+						fmt.Sprintf("unknown service %q in stage override", target),
+					}
+				}
+			}
+		}
+		apiKeys[keyName] = key
+	}
+	return nil
+}
+
+// stage applies a STAGE value: a service to swap srvName for, or a split of
+// it in the SPLIT format.
+func (self *keyConf) stage(srvName, value string) error {
+	if self.VSrvMap == nil {
+		self.VSrvMap = make(map[string]string)
+	}
+	if self.Splits == nil {
+		self.Splits = make(map[string]splitArms)
+	}
+	if !strings.Contains(value, "=") {
+		delete(self.Splits, srvName)
+		self.VSrvMap[srvName] = value
+		return nil
+	}
+	var arms, sParseErr = parseSplit(value)
+	if sParseErr != nil {
+		return sParseErr
+	}
+	delete(self.VSrvMap, srvName)
+	self.Splits[srvName] = arms
+	return nil
+}
+
+func envHasService(env []string, srvName string) bool {
+	for _, envQ := range env {
+		var envParsed = srvRe.FindStringSubmatch(envQ)
+		if len(envParsed) > 0 && envParsed[1] == srvName {
+			return true
+		}
+	}
+	return false
+}
+
+func readEnvConfig(env []string, services map[string]reverseConf, apiKeys map[string]keyConf) error {
+	for _, envQ := range env {
+		var envParsed = srvRe.FindStringSubmatch(envQ)
+		var apiKeyParsed = keyRe.FindStringSubmatch(envQ)
+		var stageKeyParsed = stageRe.FindStringSubmatch(envQ)
+		if len(envParsed) > 0 {
+			var service, param, value = envParsed[1], envParsed[2], envParsed[3]
+			var srv = services[service]
+			switch param {
+			case "UPSTREAM":
+				var upstreams, upErr = parseUpstreams(value)
+				if upErr != nil {
+					return fmt.Errorf("Error while UPSTREAM parsing in %s: %s", envQ, upErr)
+				}
+				srv.Upstream, srv.Upstreams = upstreams[0], upstreams
+			case "TIMEOUT":
+				var duration, dParseErr = time.ParseDuration(value)
+				if dParseErr != nil {
+					return fmt.Errorf("Error while TIMEOUT parsing in %s: %s", envQ, dParseErr)
+				}
+				srv.DialTimeout = duration
+			case "HOST":
+				srv.VHost = strings.Split(value, ",")
+			case "PATH":
+				srv.Paths = strings.Split(value, ",")
+			case "STRIP":
+				var strip, bParseErr = strconv.ParseBool(value)
+				if bParseErr != nil {
+					return fmt.Errorf("Error while STRIP parsing in %s: %s", envQ, bParseErr)
+				}
+				srv.StripPath = strip
+			case "REWRITE":
+				srv.RewritePath = value
+			case "REDIRECT":
+				var redirect, bParseErr = strconv.ParseBool(value)
+				if bParseErr != nil {
+					return fmt.Errorf("Error while REDIRECT parsing in %s: %s", envQ, bParseErr)
+				}
+				srv.TLSRedirect = redirect
+			case "HSTS":
+				var duration, dParseErr = time.ParseDuration(value)
+				if dParseErr != nil {
+					return fmt.Errorf("Error while HSTS parsing in %s: %s", envQ, dParseErr)
+				}
+				srv.HSTS = duration
+			case "RETRIES":
+				var retries, iParseErr = strconv.Atoi(value)
+				if iParseErr != nil {
+					return fmt.Errorf("Error while RETRIES parsing in %s: %s", envQ, iParseErr)
+				}
+				srv.Retry.Retries = retries
+			case "TRYTIMEOUT":
+				var duration, dParseErr = time.ParseDuration(value)
+				if dParseErr != nil {
+					return fmt.Errorf("Error while TRYTIMEOUT parsing in %s: %s", envQ, dParseErr)
+				}
+				srv.Retry.TryTimeout = duration
+			case "BACKOFF":
+				var duration, dParseErr = time.ParseDuration(value)
+				if dParseErr != nil {
+					return fmt.Errorf("Error while BACKOFF parsing in %s: %s", envQ, dParseErr)
+				}
+				srv.Retry.Backoff = duration
+			case "RETRYBODY":
+				var retryBody, bParseErr = strconv.ParseBool(value)
+				if bParseErr != nil {
+					return fmt.Errorf("Error while RETRYBODY parsing in %s: %s", envQ, bParseErr)
+				}
+				srv.Retry.Body = retryBody
+			case "BREAKER":
+				var failures, iParseErr = strconv.Atoi(value)
+				if iParseErr != nil {
+					return fmt.Errorf("Error while BREAKER parsing in %s: %s", envQ, iParseErr)
+				}
+				srv.Breaker.Failures = failures
+			case "ERRORRATE":
+				var rate, fParseErr = strconv.ParseFloat(value, 64)
+				if fParseErr != nil {
+					return fmt.Errorf("Error while ERRORRATE parsing in %s: %s", envQ, fParseErr)
+				}
+				srv.Breaker.ErrorRate = rate
+			case "DIRECTORS":
+				var specs, dParseErr = parseDirectors(value)
+				if dParseErr != nil {
+					return fmt.Errorf("Error while DIRECTORS parsing in %s: %s", envQ, dParseErr)
+				}
+				srv.Directors = specs
+			case "SPLIT":
+				var arms, sParseErr = parseSplit(value)
+				if sParseErr != nil {
+					return fmt.Errorf("Error while SPLIT parsing in %s: %s", envQ, sParseErr)
+				}
+				srv.Split = arms
+			case "SPLITBY":
+				srv.SplitBy = value
+			case "BALANCE":
+				srv.Balance.Method = value
+			case "CA":
+				srv.TLS.CA = value
+			case "SNI":
+				srv.TLS.ServerName = value
+			case "CERT":
+				srv.TLS.Cert = value
+			case "KEY":
+				srv.TLS.Key = value
+			case "MINTLS":
+				srv.TLS.MinVersion = value
+			case "EJECT":
+				var eject, iParseErr = strconv.Atoi(value)
+				if iParseErr != nil {
+					return fmt.Errorf("Error while EJECT parsing in %s: %s", envQ, iParseErr)
+				}
+				srv.Balance.Eject = eject
+			case "MAXIDLE":
+				var maxIdle, iParseErr = strconv.Atoi(value)
+				if iParseErr != nil {
+					return fmt.Errorf("Error while MAXIDLE parsing in %s: %s", envQ, iParseErr)
+				}
+				srv.Pool.MaxIdle = maxIdle
+			case "REQTIMEOUT", "HEADERTIMEOUT", "IDLETIMEOUT", "MAXDURATION", "POOLIDLE", "RESOLVE", "EJECTTIME":
+				var duration, dParseErr = time.ParseDuration(value)
+				if dParseErr != nil {
+					return fmt.Errorf("Error while %s parsing in %s: %s", param, envQ, dParseErr)
+				}
+				switch param {
+				case "REQTIMEOUT":
+					srv.Timeouts.Request = duration
+				case "HEADERTIMEOUT":
+					srv.Timeouts.ResponseHeader = duration
+				case "IDLETIMEOUT":
+					srv.Timeouts.Idle = duration
+				case "MAXDURATION":
+					srv.Timeouts.MaxDuration = duration
+				case "POOLIDLE":
+					srv.Pool.IdleTimeout = duration
+				case "RESOLVE":
+					srv.Balance.Resolve = duration
+				case "EJECTTIME":
+					srv.Balance.EjectTime = duration
+				}
+			case "COOLDOWN":
+				var duration, dParseErr = time.ParseDuration(value)
+				if dParseErr != nil {
+					return fmt.Errorf("Error while COOLDOWN parsing in %s: %s", envQ, dParseErr)
+				}
+				srv.Breaker.Cooldown = duration
+			default:
+				var known, limitErr = setLimit(&srv.Limits, param, value)
+				if !known {
+					return fmt.Errorf("Error while parsing in unknown param in %s: %s", envQ, param)
+				}
+				if limitErr != nil {
+					return fmt.Errorf("Error while %s parsing in %s: %s", param, envQ, limitErr)
+				}
+			}
+			services[service] = srv
+			continue
+		}
+		if len(apiKeyParsed) > 0 {
+			var keyName, param, value = apiKeyParsed[1], apiKeyParsed[2], apiKeyParsed[3]
+			var key = apiKeys[keyName]
+			switch param {
+			case "ID":
+				key.ID = value
+			case "TOKEN":
+				key.Tokens = strings.Split(value, ",")
+			default:
+				var known, limitErr = setLimit(&key.Limits, param, value)
+				if !known {
+					return fmt.Errorf("Error while parsing in unknown param in %s: %s", envQ, param)
+				}
+				if limitErr != nil {
+					return fmt.Errorf("Error while %s parsing in %s: %s", param, envQ, limitErr)
+				}
+			}
+			apiKeys[keyName] = key
+			continue
+		}
+		if len(stageKeyParsed) > 0 {
+			var keyName, param, value = stageKeyParsed[1], stageKeyParsed[2], stageKeyParsed[3]
+			var key = apiKeys[keyName]
+			if stageErr := key.stage(param, value); stageErr != nil {
+				return fmt.Errorf("Error while STAGE parsing in %s: %s", envQ, stageErr)
+			}
+			apiKeys[keyName] = key
+			continue
+		}
+		log.Println("Skipping environment variable", envQ)
+	}
+	return nil
+}
+
+// finalize fills in defaults and builds the director pipeline, the scheme
+// specific one unless configured, once both the config file and the
+// environment have been applied.
+func (self *reverseConf) finalize(srvName string) error {
+	if self.Upstream == nil {
+		return fmt.Errorf("UPSTREAM not configured for %s", srvName)
+	}
+	if !upstreamSchemes[self.Upstream.Scheme] {
+		return fmt.Errorf("Unsupported UPSTREAM scheme %s for %s", self.Upstream.Scheme, srvName)
+	}
+	if self.DialTimeout == 0 {
+		self.DialTimeout = time.Second * 10
+	}
+	for _, upstream := range self.Upstreams {
+		if upstream.Scheme != self.Upstream.Scheme {
+			return fmt.Errorf("UPSTREAM of %s mixes %s and %s", srvName, self.Upstream.Scheme, upstream.Scheme)
+		}
+	}
+	if len(self.Upstreams) > 1 && self.Upstream.Scheme != "http" && self.Upstream.Scheme != "https" {
+		return fmt.Errorf("UPSTREAM of %s lists several %s upstreams, only http and https ones are balanced", srvName, self.Upstream.Scheme)
+	}
+	if self.Upstream.Scheme == "https" {
+		var tlsConf, tlsErr = self.TLS.config()
+		if tlsErr != nil {
+			return fmt.Errorf("TLS of %s: %s", srvName, tlsErr)
+		}
+		self.TLSClient = tlsConf
+	} else if !self.TLS.empty() {
+		return fmt.Errorf("TLS settings of %s only apply to https upstreams", srvName)
+	}
+	if _, wErr := upstreamTargets(self.Upstreams); wErr != nil {
+		return fmt.Errorf("UPSTREAM of %s: %s", srvName, wErr)
+	}
+	if self.Balance.Method == "" {
+		self.Balance.Method = "roundrobin"
+	}
+	if !balanceMethods[self.Balance.Method] {
+		return fmt.Errorf("Unknown BALANCE %s for %s", self.Balance.Method, srvName)
+	}
+	if self.Balance.Resolve == 0 {
+		self.Balance.Resolve = time.Second * 30
+	}
+	if self.Balance.Eject == 0 {
+		self.Balance.Eject = 3
+	}
+	if self.Balance.EjectTime == 0 {
+		self.Balance.EjectTime = time.Second * 30
+	}
+	if len(self.VHost) == 0 {
+		return fmt.Errorf("HOST not configured for %s", srvName)
+	}
+	for i, p := range self.Paths {
+		if !strings.HasPrefix(p, "/") {
+			return fmt.Errorf("PATH %s of %s must start with /", p, srvName)
+		}
+		// "/v1/" is the same prefix as "/v1", and "/" the same as none.
+		self.Paths[i] = strings.TrimRight(p, "/")
+	}
+	if self.RewritePath != "" && !strings.HasPrefix(self.RewritePath, "/") {
+		return fmt.Errorf("REWRITE %s of %s must start with /", self.RewritePath, srvName)
+	}
+	if (self.StripPath || self.RewritePath != "") && len(self.Paths) == 0 {
+		return fmt.Errorf("STRIP and REWRITE of %s need a PATH", srvName)
+	}
+	if self.RewritePath != "" {
+		// REWRITE puts its prefix in place of the one stripped.
+		self.StripPath = true
+		self.RewritePath = strings.TrimRight(self.RewritePath, "/")
+	}
+	if self.Retry.Retries < 0 {
+		return fmt.Errorf("RETRIES must not be negative for %s", srvName)
+	}
+	if self.Retry.Retries > 0 && self.Retry.Backoff == 0 {
+		self.Retry.Backoff = time.Millisecond * 100
+	}
+	if self.Breaker.ErrorRate < 0 || self.Breaker.ErrorRate > 1 {
+		return fmt.Errorf("ERRORRATE must be between 0 and 1 for %s", srvName)
+	}
+	if self.Pool.IdleTimeout == 0 {
+		self.Pool.IdleTimeout = time.Second * 90
+	}
+	if self.Breaker.enabled() && self.Breaker.Cooldown == 0 {
+		self.Breaker.Cooldown = time.Second * 10
+	}
+	if self.Directors == nil {
+		self.Directors = defaultDirectors(self.Upstream.Scheme)
+	}
+	// Splits stick to the client_uid of the query string or form by default,
+	// like the sticky director.
+	var splitSpec = directorSpec{Params: map[string]string{}}
+	if self.SplitBy != "" {
+		splitSpec.Params["source"] = self.SplitBy
+	}
+	var locate, locErr = locatorOf(splitSpec, "client_uid")
+	if locErr != nil {
+		return fmt.Errorf("SPLITBY of %s: %s", srvName, locErr)
+	}
+	self.SplitLocate = locate
+	var directors, dErr = buildDirectors(self.Directors)
+	if dErr != nil {
+		return fmt.Errorf("DIRECTORS of %s: %s", srvName, dErr)
+	}
+	self.Director = directors
+	return nil
+}
+
+// loadConfig builds services and API keys from the config file at path (if
+// any), with SRV_/KEY_/STAGE_ variables from env applied on top of it.
+func loadConfig(path string, env []string) (map[string]reverseConf, map[string]keyConf, error) {
+	var services = map[string]reverseConf{}
+	var apiKeys = map[string]keyConf{}
+	apiKeys["common"] = keyConf{}
+
+	if path != "" {
+		if fileErr := readConfigFile(path, env, services, apiKeys); fileErr != nil {
+			return nil, nil, fileErr
+		}
+	}
+	if envErr := readEnvConfig(env, services, apiKeys); envErr != nil {
+		return nil, nil, envErr
+	}
+
+	var srvNames = make([]string, 0, len(services))
+	for srvName := range services {
+		srvNames = append(srvNames, srvName)
+	}
+	sort.Strings(srvNames)
+	for _, srvName := range srvNames {
+		var srvConf = services[srvName]
+		if confErr := srvConf.finalize(srvName); confErr != nil {
+			return nil, nil, confErr
+		}
+		services[srvName] = srvConf
+	}
+	for srvName, srvConf := range services {
+		for _, arm := range srvConf.Split {
+			if _, found := services[arm.Service]; !found {
+				return nil, nil, fmt.Errorf("No handler for %s in SPLIT of %s", arm.Service, srvName)
+			}
+		}
+	}
+	var tokens = map[string]string{}
+	for keyName, key := range apiKeys {
+		for srvName, override := range key.VSrvMap {
+			if _, found := services[override]; !found {
+				return nil, nil, fmt.Errorf("No handler for %s %s", keyName, srvName)
+			}
+		}
+		for srvName, arms := range key.Splits {
+			for _, arm := range arms {
+				if _, found := services[arm.Service]; !found {
+					return nil, nil, fmt.Errorf("No handler for %s %s in split of %s", keyName, arm.Service, srvName)
+				}
+			}
+		}
+		for _, token := range key.Tokens {
+			if token == "" {
+				return nil, nil, fmt.Errorf("Empty TOKEN for %s", keyName)
+			}
+			if other, found := tokens[token]; found {
+				return nil, nil, fmt.Errorf("TOKEN of %s reused by %s", other, keyName)
+			}
+			tokens[token] = keyName
+		}
+	}
+	return services, apiKeys, nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfig stores a config file for a test and returns its path.
+func writeConfig(t *testing.T, data string) string {
+	var f, fErr = ioutil.TempFile("", "config*.json")
+	if fErr != nil {
+		t.Fatal(fErr)
+	}
+	defer f.Close()
+	if _, wErr := f.WriteString(data); wErr != nil {
+		t.Fatal(wErr)
+	}
+	return f.Name()
+}
+
+func TestConfigErrorLines(t *testing.T) {
+	var tests = []struct {
+		name string
+		data string
+		line int
+		msg  string
+	}{
+		{"bad value after the same key elsewhere", `{
+  "services": {
+    "A": {"upstream": "http://a", "timeout": "1s"},
+    "B": {
+      "upstream": "http://b",
+      "timeout": "bogus"
+    }
+  }
+}`, 6, "bogus"},
+		{"key name inside a value", `{
+  "services": {
+    "A": {"upstream": "http://a", "host": ["timeout"]},
+    "B": {"upstream": "http://b", "timeout": "x"}
+  }
+}`, 4, "invalid duration"},
+		{"unknown service field", `{
+  "services": {
+    "A": {
+      "upstream": "http://a",
+      "tiemout": "1s"
+    }
+  }
+}`, 5, `unknown field "tiemout"`},
+		{"unknown key field", `{
+  "keys": {
+    "k": {"id": "k", "rate": 1,
+      "limit": 5}
+  }
+}`, 4, `unknown field "limit"`},
+		{"syntax error", `{
+  "services": {
+    "A": {"upstream": "http://a",}
+  }
+}`, 3, "invalid character"},
+		{"wrong type", `{
+  "services": {
+    "A": {"upstream": "http://a", "retries": "3"}
+  }
+}`, 3, "cannot unmarshal"},
+		{"unknown stage service", `{
+  "services": {"A": {"upstream": "http://a"}},
+  "keys": {
+    "k": {
+      "stage": {"A": "MISSING"}
+    }
+  }
+}`, 5, `unknown service "MISSING"`},
+		{"bad stage split", `{
+  "services": {"A": {"upstream": "http://a"}},
+  "keys": {"k": {"stage": {
+    "A": "A=x"
+  }}}
+}`, 4, "bad weight"},
+	}
+	for _, tt := range tests {
+		var path = writeConfig(t, tt.data)
+		defer os.Remove(path)
+		var err = readConfigFile(path, nil, map[string]reverseConf{}, map[string]keyConf{})
+		var cErr, ok = err.(ConfigError)
+		if !ok {
+			t.Errorf("%s: got %v, want a ConfigError", tt.name, err)
+			continue
+		}
+		if cErr.Line != tt.line || !strings.Contains(cErr.Msg, tt.msg) {
+			t.Errorf("%s: got line %d %q, want line %d %q", tt.name, cErr.Line, cErr.Msg, tt.line, tt.msg)
+		}
+	}
+}
+
+func TestConfigStage(t *testing.T) {
+	var path = writeConfig(t, `{
+  "services": {
+    "BOOKING": {"upstream": "http://booking", "host": ["booking"]}
+  },
+  "keys": {
+    "PARTNER": {"id": "partner", "tokens": ["t1"], "stage": {"BOOKING": "BOOKINGV2"}},
+    "BETA": {"stage": {"BOOKING": "BOOKING=90,BOOKINGV2=10"}}
+  }
+}`)
+	defer os.Remove(path)
+
+	// BOOKINGV2 only exists in the environment.
+	var env = []string{"SRV_BOOKINGV2_UPSTREAM=http://booking-v2", "SRV_BOOKINGV2_HOST=booking-v2"}
+	var services, apiKeys, err = loadConfig(path, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, found := services["BOOKINGV2"]; !found {
+		t.Error("BOOKINGV2 from the environment missing")
+	}
+	if got := apiKeys["PARTNER"].VSrvMap["BOOKING"]; got != "BOOKINGV2" {
+		t.Errorf("PARTNER stages BOOKING to %q", got)
+	}
+	if got := apiKeys["BETA"].Splits["BOOKING"].String(); got != "BOOKING=90,BOOKINGV2=10" {
+		t.Errorf("BETA splits BOOKING as %q", got)
+	}
+
+	// A later STAGE variable replaces a split with a plain swap.
+	env = append(env, "STAGE_BETA_BOOKING=BOOKINGV2")
+	if _, apiKeys, err = loadConfig(path, env); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := apiKeys["BETA"].Splits["BOOKING"]; found || apiKeys["BETA"].VSrvMap["BOOKING"] != "BOOKINGV2" {
+		t.Errorf("STAGE_BETA_BOOKING did not replace the split: %+v", apiKeys["BETA"])
+	}
+
+	// Without BOOKINGV2 the stage overrides point nowhere.
+	if _, _, err = loadConfig(path, nil); err == nil {
+		t.Error("stage to an unknown service accepted")
+	}
+}
+
+func TestConfigEnvMerge(t *testing.T) {
+	var path = writeConfig(t, `{
+  "services": {
+    "SEARCH": {"upstream": "http://search", "host": ["search"], "timeout": "5s", "retries": 2},
+    "BOOKING": {"upstream": "http://booking", "host": ["booking"]}
+  },
+  "keys": {
+    "PARTNER": {"id": "partner", "tokens": ["t1"], "rate": 10}
+  }
+}`)
+	defer os.Remove(path)
+
+	var services, apiKeys, err = loadConfig(path, []string{
+		"SRV_SEARCH_UPSTREAM=http://search-canary",
+		"SRV_BOOKING_RETRIES=3",
+		"KEY_PARTNER_BURST=20",
+		"KEY_OTHER_ID=other",
+		"KEY_OTHER_TOKEN=t2",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var search = services["SEARCH"]
+	if search.Upstream.Host != "search-canary" {
+		t.Errorf("SEARCH upstream %s, want the environment one", search.Upstream)
+	}
+	if search.DialTimeout != time.Second*5 || search.Retry.Retries != 2 {
+		t.Errorf("SEARCH lost its file settings: timeout %s, retries %d", search.DialTimeout, search.Retry.Retries)
+	}
+	if services["BOOKING"].Retry.Retries != 3 {
+		t.Errorf("BOOKING retries %d, want 3", services["BOOKING"].Retry.Retries)
+	}
+	var partner = apiKeys["PARTNER"]
+	if partner.ID != "partner" || partner.Limits.Rate != 10 || partner.Limits.Burst != 20 {
+		t.Errorf("PARTNER not merged: %+v", partner)
+	}
+	if apiKeys["OTHER"].ID != "other" {
+		t.Errorf("OTHER from the environment missing: %+v", apiKeys["OTHER"])
+	}
+
+	// The same token on two keys is refused whichever source it came from.
+	if _, _, err = loadConfig(path, []string{"KEY_OTHER_TOKEN=t1"}); err == nil {
+		t.Error("token reused across keys accepted")
+	}
+}
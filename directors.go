@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// directorSpec is one entry of a service's director pipeline as configured:
+// a registered director name and its parameters.
+type directorSpec struct {
+	Name   string
+	Params map[string]string
+}
+
+func (self directorSpec) String() string {
+	var keys = make([]string, 0, len(self.Params))
+	for k := range self.Params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var params = make([]string, len(keys))
+	for i, k := range keys {
+		params[i] = k + "=" + self.Params[k]
+	}
+	return JoinSkipEmpty(":", self.Name, strings.Join(params, ","))
+}
+
+func (self directorSpec) param(name, def string) string {
+	if v, found := self.Params[name]; found {
+		return v
+	}
+	return def
+}
+
+// directorFactory builds a director from its parameters.
+type directorFactory func(spec directorSpec) (func(*http.Request), error)
+
+// directorRegistry holds the directors a service can name in its pipeline.
+var directorRegistry = map[string]directorFactory{
+	"sticky": func(spec directorSpec) (func(*http.Request), error) {
+		var locate, locErr = locatorOf(spec, "client_uid")
+		if locErr != nil {
+			return nil, locErr
+		}
+		return StickyDirector(locate), nil
+	},
+	"session": func(spec directorSpec) (func(*http.Request), error) {
+		var locate, locErr = locatorOf(spec, "session")
+		if locErr != nil {
+			return nil, locErr
+		}
+		return SessionBasedDirector(locate, spec.param("vport", "13337")), nil
+	},
+	"hostname": func(spec directorSpec) (func(*http.Request), error) {
+		return HostnameBasedDirector(), nil
+	},
+}
+
+// locatorOf builds the value locator of a director from its source and param
+// parameters. The source lists locators to try in order separated by "|",
+// e.g. "header:Authorization|cookie:sid|form", and defaults to the query
+// string or POST form; param names what they look up unless they say.
+func locatorOf(spec directorSpec, defParam string) (func(*http.Request) string, error) {
+	var name = spec.param("param", defParam)
+	var locators []func(*http.Request) string
+	for _, source := range strings.Split(spec.param("source", "form"), "|") {
+		var locate, locErr = parseLocator(strings.TrimSpace(source), name)
+		if locErr != nil {
+			return nil, locErr
+		}
+		locators = append(locators, locate)
+	}
+	if len(locators) == 1 {
+		return locators[0], nil
+	}
+	return FirstOf(locators...), nil
+}
+
+// defaultDirectors is the pipeline of services that configure none.
+func defaultDirectors(scheme string) []directorSpec {
+	switch scheme {
+	case "hotcore":
+		return []directorSpec{{Name: "sticky"}, {Name: "session"}}
+	case "forward":
+		return []directorSpec{{Name: "hostname"}}
+	}
+	return nil
+}
+
+func buildDirectors(specs []directorSpec) ([]func(*http.Request), error) {
+	var res []func(*http.Request)
+	for _, spec := range specs {
+		var factory = directorRegistry[spec.Name]
+		if factory == nil {
+			return nil, fmt.Errorf("unknown director %q", spec.Name)
+		}
+		var d, dErr = factory(spec)
+		if dErr != nil {
+			return nil, fmt.Errorf("director %q: %s", spec.Name, dErr)
+		}
+		res = append(res, d)
+	}
+	return res, nil
+}
+
+// parseDirectors reads the DIRECTORS variable format, directors separated by
+// ";" with their parameters after ":", e.g.
+// "sticky:param=uid,source=cookie;session:vport=13337". An empty value is an
+// empty pipeline rather than the scheme default.
+func parseDirectors(value string) ([]directorSpec, error) {
+	var specs = []directorSpec{}
+	for _, part := range strings.Split(value, ";") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		var spec = directorSpec{Params: map[string]string{}}
+		var params string
+		if colon := strings.IndexByte(part, ':'); colon >= 0 {
+			part, params = part[:colon], part[colon+1:]
+		}
+		spec.Name = strings.TrimSpace(part)
+		for _, kv := range strings.Split(params, ",") {
+			if kv = strings.TrimSpace(kv); kv == "" {
+				continue
+			}
+			var eq = strings.IndexByte(kv, '=')
+			if eq < 0 {
+				return nil, fmt.Errorf("missing value for %q of %s", kv, spec.Name)
+			}
+			spec.Params[strings.TrimSpace(kv[:eq])] = strings.TrimSpace(kv[eq+1:])
+		}
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseDirectors(t *testing.T) {
+	var tests = []struct {
+		value string
+		want  string
+		err   string
+	}{
+		{"", "", ""},
+		{" ; ", "", ""},
+		{"hostname", "hostname", ""},
+		{"sticky:param=uid,source=cookie;session:vport=13337", "sticky:param=uid,source=cookie;session:vport=13337", ""},
+		{" sticky : source = header:Authorization|cookie:sid , ; hostname ", "sticky:source=header:Authorization|cookie:sid;hostname", ""},
+		{"sticky:param", "", `missing value for "param" of sticky`},
+		{"session:vport=1,bare", "", `missing value for "bare" of session`},
+	}
+	for _, tt := range tests {
+		var specs, err = parseDirectors(tt.value)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("parseDirectors(%q) error %v, want %q", tt.value, err, tt.err)
+			}
+			continue
+		}
+		var got = make([]string, len(specs))
+		for i, spec := range specs {
+			got[i] = spec.String()
+		}
+		if err != nil || strings.Join(got, ";") != tt.want {
+			t.Errorf("parseDirectors(%q) = %q, %v; want %q", tt.value, got, err, tt.want)
+		}
+	}
+}
+
+func TestBuildDirectors(t *testing.T) {
+	var tests = []struct {
+		value string
+		err   string
+	}{
+		{"sticky;session;hostname", ""},
+		{"sticky:source=header:X-Client|cookie:sid|json:client.id", ""},
+		{"unknown", `unknown director "unknown"`},
+		{"sticky:source=header:X-Client|body", `director "sticky": unknown source "body"`},
+		{"session:source=path:x", `director "session": bad path segment "x"`},
+		{"sticky:source=cookie:", `director "sticky": missing name for source "cookie"`},
+	}
+	for _, tt := range tests {
+		var specs, parseErr = parseDirectors(tt.value)
+		if parseErr != nil {
+			t.Errorf("parseDirectors(%q): %s", tt.value, parseErr)
+			continue
+		}
+		var directors, err = buildDirectors(specs)
+		if tt.err == "" {
+			if err != nil || len(directors) != len(specs) {
+				t.Errorf("buildDirectors(%q) = %d directors, %v", tt.value, len(directors), err)
+			}
+		} else if err == nil || err.Error() != tt.err {
+			t.Errorf("buildDirectors(%q) error %v, want %q", tt.value, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync/atomic"
+)
+
+// skynetUp is set once skynet.ListenAndServe succeeded and draining once
+// shutdown has begun.
+var skynetUp, draining int32
+
+type serviceHealth struct {
+	Service   string `json:"service"`
+	Scheme    string `json:"scheme"`
+	Upstream  string `json:"upstream"`
+	Instances int    `json:"instances"`
+	Ready     bool   `json:"ready"`
+}
+
+type readiness struct {
+	Ready    bool            `json:"ready"`
+	Skynet   bool            `json:"skynet"`
+	Draining bool            `json:"draining"`
+	Services []serviceHealth `json:"services"`
+}
+
+// upstreamService is the name a service upstream is discovered by in skynet,
+// or "" when the scheme does not go through discovery.
+func upstreamService(c reverseConf) string {
+	var host, port = splitVPort(c.Upstream.Host)
+	switch c.Upstream.Scheme {
+	case "shttp", "forward":
+		// Dialed as "name:port" unless on the default port.
+		return JoinSkipEmpty(":", host, port)
+	case "hotcore":
+		// The vport picks the ring bucket, not the service.
+		return host
+	}
+	return ""
+}
+
+func checkReadiness() readiness {
+	var res = readiness{
+		Skynet:   atomic.LoadInt32(&skynetUp) == 1,
+		Draining: atomic.LoadInt32(&draining) == 1,
+	}
+	res.Ready = res.Skynet && !res.Draining
+
+	var instances = map[string]int{}
+	for _, srv := range skynet.Services() {
+		instances[srv.Service]++
+	}
+
+	var rt = currentRouter()
+	for srvName, srvConf := range rt.Services {
+		var sh = serviceHealth{
+			Service:  srvName,
+			Scheme:   srvConf.Upstream.Scheme,
+			Upstream: srvConf.Upstream.Host,
+			Ready:    true,
+		}
+		if name := upstreamService(srvConf); name != "" {
+			sh.Instances = instances[name]
+			sh.Ready = sh.Instances > 0
+		}
+		res.Ready = res.Ready && sh.Ready
+		res.Services = append(res.Services, sh)
+	}
+	sort.Slice(res.Services, func(i, j int) bool {
+		return res.Services[i].Service < res.Services[j].Service
+	})
+	return res
+}
+
+// Healthz reports liveness: the process is up and serving.
+func Healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// Readyz reports 200 once skynet is listening and every service with a
+// skynet upstream has at least one discoverable instance, 503 otherwise.
+func Readyz(w http.ResponseWriter, r *http.Request) {
+	var res = checkReadiness()
+	w.Header().Set("Content-Type", "application/json")
+	if !res.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(res)
+}
@@ -1,32 +1,245 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"net"
 	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 )
 
-type HostSwitch map[string]http.Handler
+// HostSwitch routes requests by their Host. A vhost is an exact name, a
+// wildcard like *.api.example.com covering a single label, or a regular
+// expression marked with a leading "~" whose groups are captured for the
+// directors. Exact names take precedence over wildcards, the longest first,
+// then patterns, the longest first, then the p.<SYSHOST> fallback.
+type HostSwitch struct {
+	Hosts    map[string]http.Handler
+	Wildcard map[string]http.Handler
+	Patterns []hostPattern
+}
+
+type hostPattern struct {
+	re      *regexp.Regexp
+	handler http.Handler
+}
 
-func Index(w http.ResponseWriter, r *http.Request) {
-	var srvList = skynet.Services()
-	for _, srv := range srvList {
-		fmt.Fprintln(w, srv)
+func newHostSwitch() HostSwitch {
+	return HostSwitch{Hosts: map[string]http.Handler{}, Wildcard: map[string]http.Handler{}}
+}
+
+// vhostName builds the vhost of a HOST entry for an API key ID and a SYSHOST,
+// keeping patterns anchored with the suffix matched literally. Exact names
+// keep their case, as skynet callers dial them as configured.
+func vhostName(host, id, vSysHost string) string {
+	if strings.HasPrefix(host, "~") {
+		var suffix = JoinSkipEmpty(".", id, vSysHost)
+		if suffix != "" {
+			suffix = regexp.QuoteMeta("." + suffix)
+		}
+		var re = strings.TrimPrefix(host[1:], "^")
+		if strings.HasSuffix(re, "$") && !strings.HasSuffix(re, `\$`) {
+			re = re[:len(re)-1]
+		}
+		return "~^(?:" + re + ")" + suffix + "$"
 	}
-	var nodeList = skynet.Routes()
-	for _, srv := range nodeList {
-		fmt.Fprintln(w, srv)
+	return JoinSkipEmpty(".", host, id, vSysHost)
+}
+
+// add registers the handler of vhost, built by vhostName. Names are matched
+// case-insensitively, so two differing only in case collide.
+func (hs *HostSwitch) add(vHost string, handler http.Handler) error {
+	switch {
+	case strings.HasPrefix(vHost, "~"):
+		var re, reErr = regexp.Compile("(?i)" + vHost[1:])
+		if reErr != nil {
+			return fmt.Errorf("Error while HOST pattern parsing in %s: %s", vHost, reErr)
+		}
+		hs.Patterns = append(hs.Patterns, hostPattern{re, handler})
+		sort.SliceStable(hs.Patterns, func(i, j int) bool {
+			var a, b = hs.Patterns[i].re.String(), hs.Patterns[j].re.String()
+			if len(a) != len(b) {
+				return len(a) > len(b)
+			}
+			return a < b
+		})
+	case strings.HasPrefix(vHost, "*."):
+		var suffix = strings.ToLower(vHost[1:])
+		if hs.Wildcard[suffix] != nil {
+			return fmt.Errorf("Multiple usage of HOST %s", vHost)
+		}
+		hs.Wildcard[suffix] = handler
+	default:
+		var key = strings.ToLower(vHost)
+		if hs.Hosts[key] != nil {
+			return fmt.Errorf("Multiple usage of HOST %s", vHost)
+		}
+		hs.Hosts[key] = handler
 	}
+	return nil
+}
+
+// exact returns the handler of an exact vhost, whatever the case of vHost.
+func (hs HostSwitch) exact(vHost string) http.Handler {
+	return hs.Hosts[strings.ToLower(vHost)]
+}
+
+// normalHost lowercases host and drops its port and trailing dot.
+func normalHost(host string) string {
+	if h, _, hpErr := net.SplitHostPort(host); hpErr == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// match finds the handler for host along with the groups a pattern or
+// wildcard captured from it.
+func (hs HostSwitch) match(host string) (http.Handler, map[string]string) {
+	host = normalHost(host)
+	if handler := hs.Hosts[host]; handler != nil {
+		return handler, nil
+	}
+	if dot := strings.IndexByte(host, '.'); dot > 0 {
+		if handler := hs.Wildcard[host[dot:]]; handler != nil {
+			return handler, map[string]string{"1": host[:dot]}
+		}
+	}
+	for _, p := range hs.Patterns {
+		var groups = p.re.FindStringSubmatch(host)
+		if groups == nil {
+			continue
+		}
+		var captures = map[string]string{}
+		for i, name := range p.re.SubexpNames() {
+			if i == 0 {
+				continue
+			}
+			captures[strconv.Itoa(i)] = groups[i]
+			if name != "" {
+				captures[name] = groups[i]
+			}
+		}
+		return p.handler, captures
+	}
+	if len(sysHost) > 0 {
+		return hs.exact("p." + sysHost[0]), nil
+	}
+	return nil, nil
+}
+
+// Lookup returns the handler host is routed to, or the p.<SYSHOST> one if
+// there is none.
+func (hs HostSwitch) Lookup(host string) http.Handler {
+	var handler, _ = hs.match(host)
+	return handler
 }
 
-// Implement the ServerHTTP method on our new type
 func (hs HostSwitch) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// Check if a http.Handler is registered for the given host.
-	// If yes, use it to handle the request.
-	if handler := hs[r.Host]; handler != nil {
-		handler.ServeHTTP(w, r)
-	} else if handler = hs["p."+sysHost[0]]; handler != nil {
-		handler.ServeHTTP(w, r)
-	} else {
-		http.DefaultServeMux.ServeHTTP(w, r)
+	var handler, captures = hs.match(r.Host)
+	if handler == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if captures != nil {
+		r = r.WithContext(context.WithValue(r.Context(), ctxHost, captures))
 	}
+	handler.ServeHTTP(w, r)
+}
+
+// HostCapture returns a group captured from the Host by a wildcard or pattern
+// vhost, by name or by number.
+func HostCapture(group string) func(*http.Request) string {
+	return func(req *http.Request) string {
+		var captures, _ = req.Context().Value(ctxHost).(map[string]string)
+		return captures[group]
+	}
+}
+
+// pathRoute sends the requests of a vhost under Prefix to Handler. An empty
+// Prefix catches whatever no other route of the vhost matches.
+type pathRoute struct {
+	Prefix  string
+	Handler http.Handler
+}
+
+// PathSwitch routes the requests of a vhost shared by several services to the
+// route with the longest matching path prefix.
+type PathSwitch []pathRoute
+
+func newPathSwitch(vHost string, routes []pathRoute) (PathSwitch, error) {
+	var ps = PathSwitch(routes)
+	sort.SliceStable(ps, func(i, j int) bool { return len(ps[i].Prefix) > len(ps[j].Prefix) })
+	for i := 1; i < len(ps); i++ {
+		if ps[i].Prefix != ps[i-1].Prefix {
+			continue
+		}
+		if ps[i].Prefix == "" {
+			return nil, fmt.Errorf("Multiple usage of HOST %s", vHost)
+		}
+		return nil, fmt.Errorf("Multiple usage of PATH %s on HOST %s", ps[i].Prefix, vHost)
+	}
+	return ps, nil
+}
+
+// matchPrefix reports whether path is prefix itself or below it.
+func matchPrefix(prefix, path string) bool {
+	if prefix == "" || prefix == "/" {
+		return true
+	}
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// cleanPath resolves the dot segments and doubled slashes of a request path,
+// keeping a trailing slash.
+func cleanPath(p string) string {
+	var cleaned = path.Clean("/" + p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+// ServeHTTP matches and forwards the cleaned path, so dot segments can not
+// climb out of a prefix into the route of another service.
+func (ps PathSwitch) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if cleaned := cleanPath(r.URL.Path); cleaned != r.URL.Path {
+		var r2 = new(http.Request)
+		*r2 = *r
+		var u = *r.URL
+		u.Path, u.RawPath = cleaned, ""
+		r2.URL = &u
+		r = r2
+	}
+	for _, route := range ps {
+		if matchPrefix(route.Prefix, r.URL.Path) {
+			route.Handler.ServeHTTP(w, r)
+			return
+		}
+	}
+	http.Error(w, "No service for path "+r.URL.Path+" on "+r.Host, http.StatusNotFound)
+}
+
+// RewritePath replaces prefix of the request path with replace, "" stripping
+// it, before handing the request over to next. The two are joined on a
+// single slash whatever slashes either ends with.
+func RewritePath(prefix, replace string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var path = replace
+		if rest := strings.TrimPrefix(r.URL.Path, prefix); rest != "" {
+			path = strings.TrimSuffix(replace, "/") + "/" + strings.TrimPrefix(rest, "/")
+		}
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+		var r2 = new(http.Request)
+		*r2 = *r
+		var u = *r.URL
+		u.Path, u.RawPath = path, ""
+		r2.URL = &u
+		next.ServeHTTP(w, r2)
+	})
 }
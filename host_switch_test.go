@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRewritePath(t *testing.T) {
+	var tests = []struct {
+		prefix, replace, path, want string
+	}{
+		{"/", "/api", "/x", "/api/x"},
+		{"/", "/api/", "/x/y", "/api/x/y"},
+		{"/", "", "/x", "/x"},
+		{"/v1/search", "", "/v1/search/x", "/x"},
+		{"/v1/search", "", "/v1/search", "/"},
+		{"/v1/search", "/search", "/v1/search/x", "/search/x"},
+		{"/v1/search", "/search/", "/v1/search/x/", "/search/x/"},
+		{"/v1/search", "/search", "/v1/search", "/search"},
+	}
+	for _, tt := range tests {
+		var got string
+		var h = RewritePath(tt.prefix, tt.replace, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got = r.URL.Path
+		}))
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", tt.path, nil))
+		if got != tt.want {
+			t.Errorf("RewritePath(%q, %q) of %s = %s, want %s", tt.prefix, tt.replace, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestPathSwitchCleansPath(t *testing.T) {
+	var route = func(name string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name + " " + r.URL.Path))
+		})
+	}
+	var ps, psErr = newPathSwitch("api", []pathRoute{
+		{"/v1/search", route("search")},
+		{"/v1/booking", route("booking")},
+	})
+	if psErr != nil {
+		t.Fatal(psErr)
+	}
+	var tests = []struct{ path, want string }{
+		{"/v1/search/x", "search /v1/search/x"},
+		{"/v1/search/../booking/x", "booking /v1/booking/x"},
+		{"//v1/booking/./y/", "booking /v1/booking/y/"},
+		{"/v1/searchx", ""},
+	}
+	for _, tt := range tests {
+		var req = httptest.NewRequest("GET", "/", nil)
+		req.URL.Path = tt.path
+		var rec = httptest.NewRecorder()
+		ps.ServeHTTP(rec, req)
+		if tt.want == "" && rec.Code != http.StatusNotFound || tt.want != "" && rec.Body.String() != tt.want {
+			t.Errorf("%s went to %d %q, want %q", tt.path, rec.Code, rec.Body.String(), tt.want)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// locatorBodyLimit caps how much of a request body JSONField decodes.
+var locatorBodyLimit int64 = 1 << 20
+
+func HeaderValue(hName string) func(*http.Request) string {
+	var auth = http.CanonicalHeaderKey(hName) == "Authorization"
+	return func(req *http.Request) string {
+		var value = strings.TrimSpace(req.Header.Get(hName))
+		if auth {
+			// Drop the scheme of "Bearer <token>" and the like.
+			if space := strings.IndexByte(value, ' '); space >= 0 {
+				value = strings.TrimSpace(value[space+1:])
+			}
+		}
+		return value
+	}
+}
+
+func CookieValue(cName string) func(*http.Request) string {
+	return func(req *http.Request) string {
+		if cookie, cErr := req.Cookie(cName); cErr == nil {
+			return cookie.Value
+		}
+		return ""
+	}
+}
+
+func QueryValue(pName string) func(*http.Request) string {
+	return func(req *http.Request) string {
+		return req.URL.Query().Get(pName)
+	}
+}
+
+// PathSegment returns the idx-th segment of the request path, counting from 1.
+func PathSegment(idx int) func(*http.Request) string {
+	return func(req *http.Request) string {
+		var segments = strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+		if idx < 1 || idx > len(segments) {
+			return ""
+		}
+		return segments[idx-1]
+	}
+}
+
+// JSONField returns a string or number field of a JSON request body, with
+// dots separating the names of nested objects.
+func JSONField(fPath string) func(*http.Request) string {
+	var names = strings.Split(fPath, ".")
+	return func(req *http.Request) string {
+		if req.Body == nil || req.Body == http.NoBody {
+			return ""
+		}
+		if mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type")); mediaType != "application/json" {
+			return ""
+		}
+		var rBodyBytes, readErr = ioutil.ReadAll(io.LimitReader(req.Body, locatorBodyLimit+1))
+		if int64(len(rBodyBytes)) > locatorBodyLimit || readErr != nil {
+			req.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(rBodyBytes), req.Body), req.Body}
+			return ""
+		}
+		req.Body.Close()
+		req.Body = Closer{bytes.NewReader(rBodyBytes)}
+
+		var dec = json.NewDecoder(bytes.NewReader(rBodyBytes))
+		dec.UseNumber()
+		var value interface{}
+		if decErr := dec.Decode(&value); decErr != nil {
+			return ""
+		}
+		for _, name := range names {
+			var obj, isObj = value.(map[string]interface{})
+			if !isObj {
+				return ""
+			}
+			value = obj[name]
+		}
+		switch v := value.(type) {
+		case string:
+			return v
+		case json.Number:
+			return v.String()
+		}
+		return ""
+	}
+}
+
+// FirstOf tries the locators in order and returns the first value found.
+func FirstOf(locators ...func(*http.Request) string) func(*http.Request) string {
+	return func(req *http.Request) string {
+		for _, locate := range locators {
+			if value := locate(req); value != "" {
+				return value
+			}
+		}
+		return ""
+	}
+}
+
+// parseLocator reads one locator of a director source: a kind, optionally
+// followed by ":" and the name it looks up, the name defaulting to defName.
+// Path segments are looked up by their position and vhost captures by group
+// name or number.
+func parseLocator(source, defName string) (func(*http.Request) string, error) {
+	var kind, name = source, defName
+	if colon := strings.IndexByte(source, ':'); colon >= 0 {
+		kind, name = source[:colon], source[colon+1:]
+	}
+	if name == "" {
+		return nil, fmt.Errorf("missing name for source %q", kind)
+	}
+	switch kind {
+	case "form":
+		return FormQuery(name), nil
+	case "query":
+		return QueryValue(name), nil
+	case "header":
+		return HeaderValue(name), nil
+	case "cookie":
+		return CookieValue(name), nil
+	case "path":
+		var idx, idxErr = strconv.Atoi(name)
+		if idxErr != nil || idx < 1 {
+			return nil, fmt.Errorf("bad path segment %q", name)
+		}
+		return PathSegment(idx), nil
+	case "json":
+		return JSONField(name), nil
+	case "host":
+		return HostCapture(name), nil
+	}
+	return nil, fmt.Errorf("unknown source %q", kind)
+}
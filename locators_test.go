@@ -0,0 +1,162 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLocators(t *testing.T) {
+	var tests = []struct {
+		name   string
+		locate func(*http.Request) string
+		req    func() *http.Request
+		want   string
+	}{
+		{"header", HeaderValue("X-Client"), func() *http.Request {
+			var req = httptest.NewRequest("GET", "/", nil)
+			req.Header.Set("X-Client", " c1 ")
+			return req
+		}, "c1"},
+		{"header keeps spaces", HeaderValue("X-Client"), func() *http.Request {
+			var req = httptest.NewRequest("GET", "/", nil)
+			req.Header.Set("X-Client", "Bearer c1")
+			return req
+		}, "Bearer c1"},
+		{"authorization scheme", HeaderValue("authorization"), func() *http.Request {
+			var req = httptest.NewRequest("GET", "/", nil)
+			req.Header.Set("Authorization", "Bearer  tok")
+			return req
+		}, "tok"},
+		{"bare authorization", HeaderValue("Authorization"), func() *http.Request {
+			var req = httptest.NewRequest("GET", "/", nil)
+			req.Header.Set("Authorization", "tok")
+			return req
+		}, "tok"},
+		{"cookie", CookieValue("sid"), func() *http.Request {
+			var req = httptest.NewRequest("GET", "/", nil)
+			req.Header.Set("Cookie", "a=1; sid=s1")
+			return req
+		}, "s1"},
+		{"missing cookie", CookieValue("sid"), func() *http.Request {
+			return httptest.NewRequest("GET", "/", nil)
+		}, ""},
+		{"query", QueryValue("uid"), func() *http.Request {
+			return httptest.NewRequest("GET", "/?uid=u1", nil)
+		}, "u1"},
+		{"path segment", PathSegment(2), func() *http.Request {
+			return httptest.NewRequest("GET", "/v1/u1/orders", nil)
+		}, "u1"},
+		{"path segment past the end", PathSegment(4), func() *http.Request {
+			return httptest.NewRequest("GET", "/v1/u1/orders/", nil)
+		}, ""},
+		{"json string", JSONField("client.id"), func() *http.Request {
+			return jsonRequest(`{"client": {"id": "c1"}}`, "application/json; charset=utf-8")
+		}, "c1"},
+		{"json number", JSONField("uid"), func() *http.Request {
+			return jsonRequest(`{"uid": 12345678901234567890}`, "application/json")
+		}, "12345678901234567890"},
+		{"json object", JSONField("client"), func() *http.Request {
+			return jsonRequest(`{"client": {"id": "c1"}}`, "application/json")
+		}, ""},
+		{"json through a non-object", JSONField("client.id"), func() *http.Request {
+			return jsonRequest(`{"client": "c1"}`, "application/json")
+		}, ""},
+		{"json of another content type", JSONField("uid"), func() *http.Request {
+			return jsonRequest(`{"uid": "u1"}`, "text/plain")
+		}, ""},
+		{"invalid json", JSONField("uid"), func() *http.Request {
+			return jsonRequest(`{"uid": `, "application/json")
+		}, ""},
+		{"first found", FirstOf(HeaderValue("X-Client"), QueryValue("uid")), func() *http.Request {
+			var req = httptest.NewRequest("GET", "/?uid=u1", nil)
+			req.Header.Set("X-Client", "c1")
+			return req
+		}, "c1"},
+		{"first falls back", FirstOf(HeaderValue("X-Client"), CookieValue("sid"), QueryValue("uid")), func() *http.Request {
+			return httptest.NewRequest("GET", "/?uid=u1", nil)
+		}, "u1"},
+		{"none found", FirstOf(HeaderValue("X-Client"), QueryValue("uid")), func() *http.Request {
+			return httptest.NewRequest("GET", "/", nil)
+		}, ""},
+	}
+	for _, tt := range tests {
+		if got := tt.locate(tt.req()); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func jsonRequest(body, contentType string) *http.Request {
+	var req = httptest.NewRequest("POST", "/", strings.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	return req
+}
+
+func TestJSONFieldKeepsBody(t *testing.T) {
+	var prevLimit = locatorBodyLimit
+	locatorBodyLimit = 16
+	defer func() { locatorBodyLimit = prevLimit }()
+
+	var tests = []struct {
+		body string
+		want string
+	}{
+		{`{"uid": "u1"}`, "u1"},
+		{`{"uid": "u1", "padding": "past the limit"}`, ""},
+	}
+	for _, tt := range tests {
+		var req = jsonRequest(tt.body, "application/json")
+		if got := JSONField("uid")(req); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.body, got, tt.want)
+		}
+		var rest, readErr = ioutil.ReadAll(req.Body)
+		if readErr != nil || string(rest) != tt.body {
+			t.Errorf("%s: body read back as %q, %v", tt.body, rest, readErr)
+		}
+		if closeErr := req.Body.Close(); closeErr != nil {
+			t.Errorf("%s: closing the body: %s", tt.body, closeErr)
+		}
+	}
+}
+
+func TestParseLocator(t *testing.T) {
+	var req = httptest.NewRequest("GET", "/v1/u1?uid=q1", nil)
+	req.Header.Set("X-Client", "c1")
+	req.Header.Set("Cookie", "uid=k1")
+
+	var tests = []struct {
+		source string
+		want   string
+		err    string
+	}{
+		{"query", "q1", ""},
+		{"form:uid", "q1", ""},
+		{"header:X-Client", "c1", ""},
+		{"cookie", "k1", ""},
+		{"path:2", "u1", ""},
+		{"header:", "", "missing name"},
+		{"path", "", "bad path segment"},
+		{"path:0", "", "bad path segment"},
+		{"path:x", "", "bad path segment"},
+		{"body:uid", "", "unknown source"},
+	}
+	for _, tt := range tests {
+		var locate, err = parseLocator(tt.source, "uid")
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("parseLocator(%q) error %v, want %q", tt.source, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseLocator(%q): %s", tt.source, err)
+			continue
+		}
+		if got := locate(req); got != tt.want {
+			t.Errorf("parseLocator(%q) located %q, want %q", tt.source, got, tt.want)
+		}
+	}
+}
@@ -1,17 +1,20 @@
 package main
 
 import (
+	"crypto/tls"
 	"encoding/binary"
+	"flag"
 	"fmt"
+	"hash/crc32"
 	"log"
 	"net"
 	"net/http"
 	"net/http/httputil"
-	_ "net/http/pprof"
 	"net/url"
 	"os"
-	"regexp"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"bytes"
@@ -20,6 +23,7 @@ import (
 	"github.com/satori/go.uuid"
 	"github.com/zenhotels/astranet"
 	"github.com/zenhotels/astranet/addr"
+	"github.com/zenhotels/astranet/service"
 )
 
 var skynet astranet.AstraNet
@@ -103,22 +107,49 @@ func JoinSkipEmpty(sep string, s ...string) string {
 
 type reverseConf struct {
 	Upstream    *url.URL
+	Upstreams   []*url.URL
 	Director    []func(*http.Request)
+	Directors   []directorSpec
 	DialTimeout time.Duration
 	VHost       []string
+	Paths       []string
+	StripPath   bool
+	RewritePath string
 	Listen      string
+	Limits      limitConf
+	TLSRedirect bool
+	HSTS        time.Duration
+	Retry       retryConf
+	Breaker     breakerConf
+	Timeouts    timeoutConf
+	Pool        poolConf
+	Balance     balanceConf
+	TLS         upstreamTLSConf
+	TLSClient   *tls.Config
+	Split       splitArms
+	SplitBy     string
+	SplitLocate func(*http.Request) string
 }
 
 type keyConf struct {
 	ID      string
+	Tokens  []string
 	VSrvMap map[string]string
+	Splits  map[string]splitArms
+	Limits  limitConf
 }
 
-func mkReverse(c reverseConf) *httputil.ReverseProxy {
+// upstreamSchemes are the UPSTREAM schemes mkReverse builds a proxy for.
+var upstreamSchemes = map[string]bool{"http": true, "https": true, "shttp": true, "hotcore": true, "forward": true}
+
+func mkReverse(srvName string, c reverseConf) (*httputil.ReverseProxy, error) {
 	var reverse = &httputil.ReverseProxy{
 		FlushInterval: time.Millisecond * 10,
 		Director: func(req *http.Request) {
 			req.URL.Scheme = "http"
+			if c.Upstream.Scheme == "https" {
+				req.URL.Scheme = "https"
+			}
 			req.URL.Host = c.Upstream.Host
 			req.Host = c.Upstream.Host
 
@@ -127,18 +158,25 @@ func mkReverse(c reverseConf) *httputil.ReverseProxy {
 			}
 		},
 	}
+	var transport *http.Transport
+	var bal *balancer
 	switch c.Upstream.Scheme {
-	case "http":
+	case "http", "https":
 		var dialer = &net.Dialer{
 			Timeout:   c.DialTimeout,
 			DualStack: false,
 		}
-		reverse.Transport = &http.Transport{
-			Dial:              dialer.Dial,
-			DisableKeepAlives: false,
+		var targets, _ = upstreamTargets(c.Upstreams)
+		bal = &balancer{service: srvName, conf: c.Balance, port: "80", targets: targets}
+		transport = &http.Transport{
+			Dial: dialer.Dial,
+		}
+		if c.Upstream.Scheme == "https" {
+			bal.port = "443"
+			transport.DialTLS = dialUpstreamTLS(c.TLSClient, dialer, bal)
 		}
 	case "shttp":
-		reverse.Transport = &http.Transport{
+		transport = &http.Transport{
 			Dial: func(lnet, laddr string) (net.Conn, error) {
 				var host, port, hpErr = net.SplitHostPort(laddr)
 				if hpErr != nil {
@@ -147,12 +185,14 @@ func mkReverse(c reverseConf) *httputil.ReverseProxy {
 				if port != "80" {
 					host += ":" + port
 				}
+				if _, numErr := strconv.ParseUint(port, 10, 32); numErr != nil {
+					return skynet.DialTimeout("vport2registry", host, c.DialTimeout)
+				}
 				return skynet.DialTimeout(lnet, host, c.DialTimeout)
 			},
-			DisableKeepAlives: true,
 		}
 	case "hotcore":
-		reverse.Transport = &http.Transport{
+		transport = &http.Transport{
 			Dial: func(lnet, laddr string) (net.Conn, error) {
 				var host, port, hpErr = net.SplitHostPort(laddr)
 				if hpErr != nil {
@@ -163,10 +203,9 @@ func mkReverse(c reverseConf) *httputil.ReverseProxy {
 				}
 				return skynet.DialTimeout("vport2registry", host, c.DialTimeout)
 			},
-			DisableKeepAlives: true,
 		}
 	case "forward":
-		reverse.Transport = &http.Transport{
+		transport = &http.Transport{
 			Dial: func(lnet, laddr string) (net.Conn, error) {
 				var host, port, hpErr = net.SplitHostPort(laddr)
 				if hpErr != nil {
@@ -177,164 +216,148 @@ func mkReverse(c reverseConf) *httputil.ReverseProxy {
 				}
 				return skynet.DialTimeout(lnet, host, c.DialTimeout)
 			},
-			DisableKeepAlives: true,
 		}
 	default:
-		log.Panicln("Unsupported scheme", c.Upstream.Scheme)
+		return nil, fmt.Errorf("Unsupported scheme %s for %s", c.Upstream.Scheme, srvName)
+	}
+	c.Pool.apply(transport)
+	transport.ResponseHeaderTimeout = c.Timeouts.ResponseHeader
+	reverse.Transport = transport
+
+	switch c.Upstream.Scheme {
+	case "http", "https":
+		reverse.Transport = balancerTransport{bal, c.Upstream.Host, transport}
+	case "shttp":
+		reverse.Transport = newInstanceTransport(func(hostport string) (string, service.Selector) {
+			var host, port = splitVPort(hostport)
+			if _, numErr := strconv.ParseUint(port, 10, 32); port != "" && numErr != nil {
+				// A sticky director put its key in place of the port.
+				return host, service.HashRingSelector{VBucket: int(crc32.ChecksumIEEE([]byte(port)))}
+			}
+			return JoinSkipEmpty(":", host, port), service.RandomSelector{}
+		}, c.DialTimeout, transport)
+	case "hotcore":
+		reverse.Transport = newInstanceTransport(func(hostport string) (string, service.Selector) {
+			// Same pick as the vport2registry dial: the vport is the ring bucket.
+			var host, port = splitVPort(hostport)
+			return host, service.HashRingSelector{VBucket: int(crc32.ChecksumIEEE([]byte(port)))}
+		}, c.DialTimeout, transport)
+	case "forward":
+		reverse.Transport = newInstanceTransport(func(hostport string) (string, service.Selector) {
+			var host, port = splitVPort(hostport)
+			return JoinSkipEmpty(":", host, port), service.RandomSelector{}
+		}, c.DialTimeout, transport)
 	}
-	return reverse
+	if c.Breaker.enabled() {
+		reverse.Transport = hostBreakerTransport{getBreaker(srvName), c.Breaker, reverse.Transport}
+	}
+	if c.Retry.Retries > 0 || c.Retry.TryTimeout > 0 {
+		reverse.Transport = retryTransport{c.Retry, reverse.Transport}
+	}
+	reverse.Transport = timeoutTransport{c.Timeouts, reverse.Transport}
+	return reverse, nil
 }
 
 var httpPort = os.Getenv("HTTP_PORT")
 var skyPort = os.Getenv("SKYNET_PORT")
+var adminPort = os.Getenv("ADMIN_PORT")
+var adminBind = os.Getenv("ADMIN_BIND")
 var sysHost = strings.Split(os.Getenv("SYSHOST"), ",")
 
-var services = map[string]reverseConf{}
-var apiKeys = map[string]keyConf{}
-
-var srvRe = regexp.MustCompilePOSIX("SRV_([A-Z0-9_]*)_([A-Z0-9_]*)=(.*)")
-var keyRe = regexp.MustCompilePOSIX("KEY_([A-Z0-9_]*)_([A-Z0-9_]*)=(.*)")
-var stageRe = regexp.MustCompilePOSIX("STAGE_([A-Z0-9_]*)_([A-Z0-9_]*)=(.*)")
-
 func main() {
+	flag.Parse()
 	if os.Getenv("MPXROUTER") == "" {
 		skynet = astranet.New().Router()
 	} else {
 		skynet = astranet.New()
 	}
+	if rateLimitShared {
+		// The limiter owner picked from the hash ring may be this very node.
+		skynet = skynet.WithLoopBack()
+	}
 	if skyPort == "" {
 		skyPort = "10000"
 	}
 	if httpPort == "" {
 		httpPort = "8080"
 	}
+	if adminPort == "" {
+		adminPort = "8081"
+	}
+	if adminBind == "" {
+		adminBind = "0.0.0.0:" + adminPort
+	}
+	if skyTLSErr := setupSkynetTLS(); skyTLSErr != nil {
+		log.Panicln(skyTLSErr)
+	}
 	skynet.Services()
 	var httpBind = "0.0.0.0:" + httpPort
 
-	apiKeys["common"] = keyConf{}
+	if reloadErr := reload(); reloadErr != nil {
+		log.Panicln(reloadErr)
+	}
+	go watchReload(time.Second * 5)
+	log.Println("Serving HTTP on", httpBind)
 
-	for _, envQ := range os.Environ() {
-		var envParsed = srvRe.FindStringSubmatch(envQ)
-		var apiKeyParsed = keyRe.FindStringSubmatch(envQ)
-		var stageKeyParsed = stageRe.FindStringSubmatch(envQ)
-		if len(envParsed) > 0 {
-			var service, param, value = envParsed[1], envParsed[2], envParsed[3]
-			var srv = services[service]
-			switch param {
-			case "UPSTREAM":
-				var upstream, upErr = url.Parse(value)
-				if upErr != nil {
-					log.Panicln("Error while UPSTREAM parsing in", envQ, upErr)
-				}
-				srv.Upstream = upstream
-				if upstream.Scheme == "hotcore" {
-					srv.Director = append(
-						srv.Director,
-						StickyDirector(FormQuery("client_uid")),
-						SessionBasedDirector(FormQuery("session"), "13337"),
-					)
-				}
-				if upstream.Scheme == "forward" {
-					srv.Director = append(
-						srv.Director,
-						HostnameBasedDirector(),
-					)
-				}
-			case "TIMEOUT":
-				var duration, dParseErr = time.ParseDuration(value)
-				if dParseErr != nil {
-					log.Panicln("Error while TIMEOUT parsing in", envQ, dParseErr)
-				}
-				srv.DialTimeout = duration
-			case "HOST":
-				srv.VHost = strings.Split(value, ",")
-			default:
-				log.Panicln("Error while parsing in unknown param in", envQ, param)
-			}
-			services[service] = srv
-			continue
+	if rateLimitShared {
+		var limitL, limitLErr = skynet.Bind("", rateLimitService)
+		if limitLErr != nil {
+			log.Panicln("Failed while binding skynet to", rateLimitService)
 		}
-		if len(apiKeyParsed) > 0 {
-			var keyName, param, value = apiKeyParsed[1], apiKeyParsed[2], apiKeyParsed[3]
-			var key = apiKeys[keyName]
-			switch param {
-			case "ID":
-				key.ID = value
-			default:
-				log.Panicln("Error while parsing in unknown param in", envQ, param)
-			}
-			apiKeys[keyName] = key
-			continue
-		}
-		if len(stageKeyParsed) > 0 {
-			var keyName, param, value = stageKeyParsed[1], stageKeyParsed[2], stageKeyParsed[3]
-			var key = apiKeys[keyName]
-			if key.VSrvMap == nil {
-				key.VSrvMap = make(map[string]string)
-			}
-			key.VSrvMap[param] = value
-			apiKeys[keyName] = key
+		extraBinds = append(extraBinds, limitL)
+		go newServer("", http.HandlerFunc(RateLimitServer)).Serve(limitL)
+	}
+
+	go func() {
+		if adminErr := newServer(adminBind, AdminAuth(adminMux)).ListenAndServe(); adminErr != nil {
+			log.Panicln(adminErr)
 		}
-		log.Println("Skipping environment variable", envQ)
+	}()
+
+	var skyL, srvErr = skynetListenAndServe("tcp4", "0.0.0.0:"+skyPort)
+	if srvErr != nil {
+		log.Panicln(srvErr)
 	}
+	extraBinds = append(extraBinds, skyL)
+	atomic.StoreInt32(&skynetUp, 1)
+	go joinSeeds()
 
-	var hMap = map[string]http.Handler{}
+	var srv = newServer(httpBind, ACMEChallenge(LiveSwitch{}))
+	var servers = []*http.Server{srv}
 
-	for srvName, srvConf := range services {
-		if srvConf.Upstream.Scheme == "" {
-			srvConf.Upstream.Scheme = "shttp"
-		}
-		if srvConf.Upstream == nil {
-			log.Panicln("UPSTREAM not configured for", srvName)
-		}
-		if srvConf.DialTimeout == 0 {
-			srvConf.DialTimeout = time.Second * 10
+	if httpsPort != "" {
+		if certDir == "" {
+			log.Panicln("TLS_CERT_DIR not configured for HTTPS_PORT")
 		}
-		if len(srvConf.VHost) == 0 {
-			log.Panicln("HOST not configured for", srvName)
+		if certErr := certs.load(certDir); certErr != nil {
+			log.Panicln(certErr)
 		}
-		services[srvName] = srvConf
-		hMap[srvName] = mkReverse(srvConf)
-	}
-
-	var hs = make(HostSwitch)
+		go certs.watch(certDir, time.Second*30)
 
-	for apiId, apiKey := range apiKeys {
-		for srvName, srvConf := range services {
-			var r = hMap[srvName]
-			if override, found := apiKey.VSrvMap[srvName]; found {
-				r = hMap[override]
-			}
-			if r == nil {
-				log.Panicln("No handler for", apiId, srvName)
+		var tlsSrv = newServer("0.0.0.0:"+httpsPort, LiveSwitch{})
+		tlsSrv.TLSConfig = &tls.Config{GetCertificate: certs.GetCertificate}
+		servers = append(servers, tlsSrv)
+		go func() {
+			if tlsErr := tlsSrv.ListenAndServeTLS("", ""); tlsErr != http.ErrServerClosed {
+				log.Panic(tlsErr)
 			}
-			for _, vHost := range srvConf.VHost {
-				for _, vSysHost := range sysHost {
-					var vHost = JoinSkipEmpty(".", vHost, apiKey.ID, vSysHost)
-					if hs[vHost] != nil {
-						log.Panicln("Multiple usage of HOST", vHost)
-					}
-					hs[vHost] = r
-					log.Println("Serving HTTP for", vHost, "on", httpBind)
+		}()
+		log.Println("Serving HTTPS on", tlsSrv.Addr)
 
-					var skyL, skyLErr = skynet.Bind("", vHost)
-					if skyLErr != nil {
-						log.Panicln("Failed while binding skynet to", vHost)
-					}
-					go http.Serve(skyL, r)
-					log.Println("Serving SHTTP for", vHost)
-				}
-			}
+		if acmeDirectory != "" {
+			go acmeLoop()
 		}
 	}
 
-	http.DefaultServeMux.HandleFunc("/", Index)
-
-	if srvErr := skynet.ListenAndServe("tcp4", "0.0.0.0:"+skyPort); srvErr != nil {
-		log.Panicln(srvErr)
-	}
+	var stopped = make(chan struct{})
+	go func() {
+		waitShutdown(servers...)
+		close(stopped)
+	}()
 
-	if httpServeErr := http.ListenAndServe(httpBind, hs); httpServeErr != nil {
+	if httpServeErr := srv.ListenAndServe(); httpServeErr != http.ErrServerClosed {
 		log.Panic(httpServeErr)
 	}
+	<-stopped
+	log.Println("Shutdown complete")
 }
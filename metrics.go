@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+var metricsRegistry = metrics.NewRegistry()
+
+// latencyBuckets are the upper bounds in seconds of the request duration
+// histogram.
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// reqLabels identify one proxied traffic series.
+type reqLabels struct {
+	Service string
+	VHost   string
+	APIKey  string
+	Scheme  string
+}
+
+func (self reqLabels) String() string {
+	return fmt.Sprintf(
+		`service=%q,vhost=%q,api_key=%q,scheme=%q`,
+		self.Service, self.VHost, self.APIKey, self.Scheme,
+	)
+}
+
+// passWriter passes Flush and Hijack through to the ResponseWriter it wraps,
+// for the writers that rewrite or record what the proxy writes.
+type passWriter struct {
+	http.ResponseWriter
+}
+
+func (self passWriter) Flush() {
+	if f, ok := self.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (self passWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := self.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, fmt.Errorf("Hijack not supported")
+}
+
+// statusWriter records the status code and body size written through it.
+type statusWriter struct {
+	passWriter
+	status int
+	bytes  int64
+}
+
+func (self *statusWriter) WriteHeader(code int) {
+	if self.status == 0 {
+		self.status = code
+	}
+	self.ResponseWriter.WriteHeader(code)
+}
+
+func (self *statusWriter) Write(b []byte) (int, error) {
+	if self.status == 0 {
+		self.status = http.StatusOK
+	}
+	var n, err = self.ResponseWriter.Write(b)
+	self.bytes += int64(n)
+	return n, err
+}
+
+func (self *statusWriter) Status() int {
+	if self.status == 0 {
+		return http.StatusOK
+	}
+	return self.status
+}
+
+func observeRequest(labels reqLabels, status int, took time.Duration) {
+	var series = labels.String() + `,code="` + strconv.Itoa(status) + `"`
+	metrics.GetOrRegisterCounter("api_endpoint_requests_total{"+series+"}", metricsRegistry).Inc(1)
+
+	var seconds = took.Seconds()
+	for _, le := range latencyBuckets {
+		if seconds <= le {
+			metrics.GetOrRegisterCounter(
+				"api_endpoint_request_duration_seconds_bucket{"+labels.String()+`,le="`+
+					strconv.FormatFloat(le, 'g', -1, 64)+`"}`, metricsRegistry,
+			).Inc(1)
+		}
+	}
+	metrics.GetOrRegisterCounter(
+		"api_endpoint_request_duration_seconds_bucket{"+labels.String()+`,le="+Inf"}`, metricsRegistry,
+	).Inc(1)
+	metrics.GetOrRegisterCounter(
+		"api_endpoint_request_duration_seconds_count{"+labels.String()+"}", metricsRegistry,
+	).Inc(1)
+	metrics.GetOrRegisterCounter(
+		"api_endpoint_request_duration_seconds_sum_us{"+labels.String()+"}", metricsRegistry,
+	).Inc(took.Nanoseconds() / 1000)
+}
+
+// Instrument counts requests and their latency under labels.
+func Instrument(labels reqLabels, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var start = time.Now()
+		var sw = &statusWriter{passWriter: passWriter{w}}
+		defer func() {
+			observeRequest(labels, sw.Status(), time.Since(start))
+		}()
+		next.ServeHTTP(sw, r)
+	})
+}
+
+// Metrics renders the registry in the Prometheus text exposition format.
+func Metrics(w http.ResponseWriter, r *http.Request) {
+	var lines = map[string][]string{}
+	metricsRegistry.Each(func(name string, m interface{}) {
+		var c, ok = m.(metrics.Counter)
+		if !ok {
+			return
+		}
+		var family = name[:strings.IndexByte(name, '{')]
+		var value = strconv.FormatInt(c.Count(), 10)
+		if strings.HasSuffix(family, "_sum_us") {
+			family = strings.TrimSuffix(family, "_us")
+			name = family + name[strings.IndexByte(name, '{'):]
+			value = strconv.FormatFloat(float64(c.Count())/1e6, 'f', -1, 64)
+		}
+		lines[family] = append(lines[family], name+" "+value)
+	})
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintln(w, "# TYPE api_endpoint_requests_total counter")
+	writeSorted(w, lines["api_endpoint_requests_total"])
+	fmt.Fprintln(w, "# TYPE api_endpoint_request_duration_seconds histogram")
+	writeSorted(w, lines["api_endpoint_request_duration_seconds_bucket"])
+	writeSorted(w, lines["api_endpoint_request_duration_seconds_sum"])
+	writeSorted(w, lines["api_endpoint_request_duration_seconds_count"])
+	fmt.Fprintln(w, "# TYPE api_endpoint_circuit_state gauge")
+	var states []string
+	for _, v := range breakerViews("") {
+		states = append(states, fmt.Sprintf(
+			"api_endpoint_circuit_state{service=%q,host=%q,state=%q} 1", v.Service, v.Host, v.State,
+		))
+	}
+	writeSorted(w, states)
+	fmt.Fprintln(w, "# TYPE api_endpoint_circuit_trips_total counter")
+	writeSorted(w, lines["api_endpoint_circuit_trips_total"])
+	fmt.Fprintln(w, "# TYPE api_endpoint_circuit_rejected_total counter")
+	writeSorted(w, lines["api_endpoint_circuit_rejected_total"])
+	fmt.Fprintln(w, "# TYPE api_endpoint_split_requests_total counter")
+	writeSorted(w, lines["api_endpoint_split_requests_total"])
+	fmt.Fprintln(w, "# TYPE api_endpoint_astranet_routes gauge")
+	fmt.Fprintln(w, "api_endpoint_astranet_routes", len(skynet.Routes()))
+	fmt.Fprintln(w, "# TYPE api_endpoint_astranet_services gauge")
+	fmt.Fprintln(w, "api_endpoint_astranet_services", len(skynet.Services()))
+}
+
+func writeSorted(w http.ResponseWriter, lines []string) {
+	sort.Strings(lines)
+	for _, l := range lines {
+		fmt.Fprintln(w, l)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zenhotels/astranet/addr"
+	"github.com/zenhotels/astranet/service"
+)
+
+// poolConf sizes the keep-alive pool of a service: MaxIdle connections are
+// kept per upstream instance for up to IdleTimeout. A negative MaxIdle turns
+// keep-alive off.
+type poolConf struct {
+	MaxIdle     int
+	IdleTimeout time.Duration
+}
+
+func (self poolConf) apply(t *http.Transport) {
+	t.DisableKeepAlives = self.MaxIdle < 0
+	t.MaxIdleConnsPerHost = self.MaxIdle
+	t.IdleConnTimeout = self.IdleTimeout
+}
+
+// pickInstance chooses an instance of the skynet service sname with selector,
+// avoiding the ones already tried for the request and those with an open
+// circuit. It fails with errCircuitOpen rather than pick a host whose circuit
+// sheds the request, which is all that is left once every host tripped.
+// Instances behind a router are dialed by name, so whichever host serves the
+// request is unknown and neither retries nor the host breaker hear of it.
+func pickInstance(ctx context.Context, sname string, selector service.Selector, timeout time.Duration) (service.ServiceInfo, error) {
+	var state, _ = ctx.Value(ctxRetry).(*retryState)
+	var try, _ = ctx.Value(ctxBreaker).(*hostTry)
+	var exclude, blocked = "", ""
+	if state != nil {
+		exclude = state.exclude()
+	}
+	if try != nil {
+		blocked = try.service.blockedHosts(try.conf)
+	}
+	for {
+		var srv, found = skynet.ServiceMap().DiscoverTimeout(excludeSelector{selector, exclude, blocked}, sname, timeout, service.UniqueHP)
+		if !found {
+			return srv, &net.AddrError{Err: "Host not found", Addr: sname}
+		}
+		if try != nil && srv.Priority == 0 {
+			var host = try.service.host(srv.Host)
+			if !host.allow(try.conf, time.Now()) {
+				var key = "," + hostKey(srv.Host) + ","
+				if strings.Contains(blocked, key) {
+					// The selector fell back on a blocked host: none is left.
+					return srv, errCircuitOpen
+				}
+				// Another request took the half-open probe meanwhile.
+				blocked += key
+				continue
+			}
+			try.host = host
+		}
+		if state != nil && srv.Priority == 0 {
+			state.add(hostKey(srv.Host))
+		}
+		return srv, nil
+	}
+}
+
+// instanceTransport resolves the skynet instance a request goes to before
+// http.Transport picks a connection, so connections are pooled per instance
+// and only reused for requests that would have been routed there anyway.
+// Requests already addressed to an instance, like session routed ones, pass
+// as they are. Instances only reachable through a router can not be
+// addressed directly and are left to the dial by name on routed, which keeps
+// no connections: a pooled one would pin every later request to whatever
+// instance it first reached.
+type instanceTransport struct {
+	resolve func(hostport string) (string, service.Selector)
+	timeout time.Duration
+	next    *http.Transport
+	routed  *http.Transport
+}
+
+func newInstanceTransport(resolve func(hostport string) (string, service.Selector), timeout time.Duration, next *http.Transport) instanceTransport {
+	var routed = next.Clone()
+	routed.DisableKeepAlives = true
+	return instanceTransport{resolve, timeout, next, routed}
+}
+
+func (self instanceTransport) CloseIdleConnections() {
+	self.next.CloseIdleConnections()
+}
+
+func (self instanceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var host, _, hpErr = net.SplitHostPort(req.URL.Host)
+	if hpErr != nil {
+		host = req.URL.Host
+	}
+	if _, addrErr := addr.Host2Uint(host); addrErr == nil {
+		return self.next.RoundTrip(req)
+	}
+	var sname, selector = self.resolve(req.URL.Host)
+	var srv, pickErr = pickInstance(req.Context(), sname, selector, self.timeout)
+	if pickErr != nil {
+		return nil, pickErr
+	}
+	if srv.Priority != 0 {
+		return self.routed.RoundTrip(req)
+	}
+	var out = new(http.Request)
+	*out = *req
+	var u = *req.URL
+	u.Host = net.JoinHostPort(addr.Uint2Host(srv.Host), strconv.Itoa(int(srv.Port)))
+	out.URL = &u
+	return self.next.RoundTrip(out)
+}
+
+// splitVPort splits an upstream host into the service name and the port the
+// dialers see, "" standing for the default one.
+func splitVPort(hostport string) (string, string) {
+	var host, port, hpErr = net.SplitHostPort(hostport)
+	if hpErr != nil {
+		return hostport, ""
+	}
+	if port == "80" {
+		port = ""
+	}
+	return host, port
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"encoding/json"
+	"hash/crc32"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const rateLimitService = "api_endpoint.ratelimit"
+
+var rateLimitShared = os.Getenv("RATELIMIT_SHARED") != ""
+
+// limitConf is a token bucket of Rate requests per second holding up to Burst
+// tokens, plus optional daily and monthly request quotas. Zero disables each.
+type limitConf struct {
+	Rate    float64
+	Burst   int64
+	Daily   int64
+	Monthly int64
+}
+
+func (self limitConf) empty() bool {
+	return self.Rate == 0 && self.Daily == 0 && self.Monthly == 0
+}
+
+func (self limitConf) burst() int64 {
+	if self.Burst > 0 {
+		return self.Burst
+	}
+	return int64(math.Max(1, math.Ceil(self.Rate)))
+}
+
+type limitDecision struct {
+	Allowed    bool
+	Limit      int64
+	Remaining  int64
+	Reset      time.Duration
+	RetryAfter time.Duration
+}
+
+// tighter keeps whichever of the two decisions leaves less headroom.
+func (self limitDecision) tighter(other limitDecision) limitDecision {
+	if !other.Allowed && self.Allowed {
+		return other
+	}
+	if other.Allowed == self.Allowed && other.Remaining < self.Remaining {
+		return other
+	}
+	return self
+}
+
+type quota struct {
+	period func(time.Time) (time.Time, time.Time)
+	start  time.Time
+	used   int64
+}
+
+func dayPeriod(now time.Time) (time.Time, time.Time) {
+	var y, m, d = now.UTC().Date()
+	var start = time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	return start, start.AddDate(0, 0, 1)
+}
+
+func monthPeriod(now time.Time) (time.Time, time.Time) {
+	var y, m, _ = now.UTC().Date()
+	var start = time.Date(y, m, 1, 0, 0, 0, 0, time.UTC)
+	return start, start.AddDate(0, 1, 0)
+}
+
+func (self *quota) check(limit int64, now time.Time) limitDecision {
+	var start, end = self.period(now)
+	if !start.Equal(self.start) {
+		self.start, self.used = start, 0
+	}
+	var d = limitDecision{
+		Allowed:   self.used < limit,
+		Limit:     limit,
+		Remaining: limit - self.used - 1,
+		Reset:     end.Sub(now),
+	}
+	if !d.Allowed {
+		d.Remaining = 0
+		d.RetryAfter = d.Reset
+	}
+	return d
+}
+
+type limitState struct {
+	sync.Mutex
+	conf    limitConf
+	tokens  float64
+	last    time.Time
+	daily   quota
+	monthly quota
+}
+
+func newLimitState(conf limitConf) *limitState {
+	return &limitState{
+		conf:    conf,
+		tokens:  float64(conf.burst()),
+		daily:   quota{period: dayPeriod},
+		monthly: quota{period: monthPeriod},
+	}
+}
+
+// take checks every configured limit and only consumes from them if all of
+// them allow the request.
+func (self *limitState) take(now time.Time) limitDecision {
+	self.Lock()
+	defer self.Unlock()
+
+	var d = limitDecision{Allowed: true, Remaining: math.MaxInt64}
+	if self.conf.Rate > 0 {
+		var burst = float64(self.conf.burst())
+		if !self.last.IsZero() {
+			self.tokens = math.Min(burst, self.tokens+now.Sub(self.last).Seconds()*self.conf.Rate)
+		}
+		self.last = now
+		var bd = limitDecision{
+			Allowed:   self.tokens >= 1,
+			Limit:     int64(burst),
+			Remaining: int64(math.Max(0, self.tokens-1)),
+			Reset:     time.Duration((burst - self.tokens + 1) / self.conf.Rate * float64(time.Second)),
+		}
+		if !bd.Allowed {
+			bd.RetryAfter = time.Duration((1 - self.tokens) / self.conf.Rate * float64(time.Second))
+		}
+		d = d.tighter(bd)
+	}
+	if self.conf.Daily > 0 {
+		d = d.tighter(self.daily.check(self.conf.Daily, now))
+	}
+	if self.conf.Monthly > 0 {
+		d = d.tighter(self.monthly.check(self.conf.Monthly, now))
+	}
+	if d.Allowed {
+		if self.conf.Rate > 0 {
+			self.tokens--
+		}
+		self.daily.used++
+		self.monthly.used++
+	}
+	return d
+}
+
+// refund gives back what an allowed take consumed, for a request another
+// limit rejected.
+func (self *limitState) refund(now time.Time) {
+	self.Lock()
+	defer self.Unlock()
+	if self.conf.Rate > 0 {
+		self.tokens = math.Min(float64(self.conf.burst()), self.tokens+1)
+	}
+	for _, q := range []*quota{&self.daily, &self.monthly} {
+		if start, _ := q.period(now); start.Equal(q.start) && q.used > 0 {
+			q.used--
+		}
+	}
+}
+
+// limiters outlive reloads so a config change does not hand out fresh quotas.
+var limiters = struct {
+	sync.Mutex
+	m map[string]*limitState
+}{m: map[string]*limitState{}}
+
+func localRefund(name string) {
+	limiters.Lock()
+	var st = limiters.m[name]
+	limiters.Unlock()
+	if st != nil {
+		st.refund(time.Now())
+	}
+}
+
+func localTake(name string, conf limitConf) limitDecision {
+	limiters.Lock()
+	var st = limiters.m[name]
+	if st == nil {
+		st = newLimitState(conf)
+		limiters.m[name] = st
+	}
+	limiters.Unlock()
+
+	st.Lock()
+	if st.conf != conf {
+		st.conf = conf
+		st.tokens = math.Min(st.tokens, float64(conf.burst()))
+	}
+	st.Unlock()
+	return st.take(time.Now())
+}
+
+// limitClient reaches the instance owning a limiter. The request host is a
+// hash of the limiter name and dialing it with a registry:// network makes
+// skynet pick the owner from a hash ring, so every endpoint instance agrees
+// on where a given limiter lives.
+var limitClient = &http.Client{
+	Transport: &http.Transport{
+		Dial: func(lnet, laddr string) (net.Conn, error) {
+			var bucket, _, hpErr = net.SplitHostPort(laddr)
+			if hpErr != nil {
+				return nil, hpErr
+			}
+			return skynet.DialTimeout("registry://"+bucket, rateLimitService, time.Second)
+		},
+		DisableKeepAlives: true,
+	},
+	Timeout: time.Second * 2,
+}
+
+func (self limitConf) query(name string) url.Values {
+	return url.Values{
+		"name":    {name},
+		"rate":    {strconv.FormatFloat(self.Rate, 'g', -1, 64)},
+		"burst":   {strconv.FormatInt(self.Burst, 10)},
+		"daily":   {strconv.FormatInt(self.Daily, 10)},
+		"monthly": {strconv.FormatInt(self.Monthly, 10)},
+	}
+}
+
+func remoteTake(name string, conf limitConf) (d limitDecision, err error) {
+	var req, reqErr = http.NewRequest("POST", limitURL(name, "take")+"?"+conf.query(name).Encode(), nil)
+	if reqErr != nil {
+		return d, reqErr
+	}
+	var resp, respErr = limitClient.Do(req)
+	if respErr != nil {
+		return d, respErr
+	}
+	defer resp.Body.Close()
+	err = json.NewDecoder(resp.Body).Decode(&d)
+	return d, err
+}
+
+func limitURL(name, op string) string {
+	return "http://b" + strconv.FormatUint(uint64(crc32.ChecksumIEEE([]byte(name))), 16) + "/" + op
+}
+
+func remoteRefund(name string) error {
+	var resp, respErr = limitClient.PostForm(limitURL(name, "refund"), url.Values{"name": {name}})
+	if respErr != nil {
+		return respErr
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func takeLimit(name string, conf limitConf) limitDecision {
+	if rateLimitShared {
+		var d, remoteErr = remoteTake(name, conf)
+		if remoteErr == nil {
+			return d
+		}
+		log.Println("Shared rate limit unavailable, using local state for", name, remoteErr)
+	}
+	return localTake(name, conf)
+}
+
+// refundLimit gives back a take of name, where it was taken.
+func refundLimit(name string) {
+	if rateLimitShared {
+		if remoteErr := remoteRefund(name); remoteErr != nil {
+			log.Println("Shared rate limit unavailable, refunding local state for", name, remoteErr)
+			localRefund(name)
+		}
+		return
+	}
+	localRefund(name)
+}
+
+// RateLimitServer answers take and refund requests from other endpoint
+// instances for the limiters this instance owns.
+func RateLimitServer(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/refund" {
+		localRefund(r.FormValue("name"))
+		return
+	}
+	var q = r.URL.Query()
+	var conf limitConf
+	conf.Rate, _ = strconv.ParseFloat(q.Get("rate"), 64)
+	conf.Burst, _ = strconv.ParseInt(q.Get("burst"), 10, 64)
+	conf.Daily, _ = strconv.ParseInt(q.Get("daily"), 10, 64)
+	conf.Monthly, _ = strconv.ParseInt(q.Get("monthly"), 10, 64)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(localTake(q.Get("name"), conf))
+}
+
+type namedLimit struct {
+	Name string
+	Conf limitConf
+}
+
+// RateLimit enforces the given limits before handing the request to next,
+// answering 429 with Retry-After once any of them is exhausted. A rejected
+// request gives back what the limits that allowed it consumed.
+func RateLimit(limits []namedLimit, next http.Handler) http.Handler {
+	if len(limits) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var d = limitDecision{Allowed: true, Remaining: math.MaxInt64}
+		var taken = make([]string, 0, len(limits))
+		for _, l := range limits {
+			var ld = takeLimit(l.Name, l.Conf)
+			if ld.Allowed {
+				taken = append(taken, l.Name)
+			}
+			d = d.tighter(ld)
+		}
+		if !d.Allowed {
+			for _, name := range taken {
+				refundLimit(name)
+			}
+		}
+		w.Header().Set("X-RateLimit-Limit", strconv.FormatInt(d.Limit, 10))
+		w.Header().Set("X-RateLimit-Remaining", strconv.FormatInt(d.Remaining, 10))
+		w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(int64(math.Ceil(d.Reset.Seconds())), 10))
+		if !d.Allowed {
+			w.Header().Set("Retry-After", strconv.FormatInt(int64(math.Ceil(d.RetryAfter.Seconds())), 10))
+			http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
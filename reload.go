@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Router is one generation of the routing state built from services and API
+// keys. A reload builds a new Router and swaps it in as a whole.
+type Router struct {
+	Services map[string]reverseConf
+	APIKeys  map[string]keyConf
+	Switch   HostSwitch
+	VHosts   map[string][]vhostInfo
+	Handlers map[string]http.Handler
+
+	proxies []*httputil.ReverseProxy
+	active  int64
+}
+
+var current atomic.Value
+
+var skyBinds = map[string]net.Listener{}
+var reloadLock sync.Mutex
+
+var drainTimeout = time.Minute
+
+func currentRouter() *Router {
+	var rt, _ = current.Load().(*Router)
+	return rt
+}
+
+func buildRouter(services map[string]reverseConf, apiKeys map[string]keyConf) (*Router, error) {
+	var rt = &Router{
+		Services: services,
+		APIKeys:  apiKeys,
+		Switch:   newHostSwitch(),
+		VHosts:   map[string][]vhostInfo{},
+		Handlers: map[string]http.Handler{},
+	}
+
+	for srvName, srvConf := range services {
+		var rp, rpErr = mkReverse(srvName, srvConf)
+		if rpErr != nil {
+			return nil, rpErr
+		}
+		rt.proxies = append(rt.proxies, rp)
+		rt.Handlers[srvName] = CircuitBreaker(srvName, srvConf.Breaker, Deadline(srvConf.Timeouts, rp))
+	}
+
+	var tokens = map[string]string{}
+	for apiId, apiKey := range apiKeys {
+		for _, token := range apiKey.Tokens {
+			tokens[token] = apiId
+		}
+	}
+
+	var routes = map[string][]pathRoute{}
+	for apiId, apiKey := range apiKeys {
+		for srvName, srvConf := range services {
+			var resolved = srvName
+			if override, found := apiKey.VSrvMap[srvName]; found {
+				resolved = override
+			}
+			var r = rt.Handlers[resolved]
+			if r == nil {
+				return nil, fmt.Errorf("No handler for %s %s", apiId, srvName)
+			}
+			var arms = srvConf.Split
+			if keyArms, found := apiKey.Splits[srvName]; found {
+				arms = keyArms
+			} else if resolved != srvName {
+				arms = nil
+			}
+			if len(arms) > 0 {
+				var handlers = make([]http.Handler, len(arms))
+				for i, arm := range arms {
+					if handlers[i] = rt.Handlers[arm.Service]; handlers[i] == nil {
+						return nil, fmt.Errorf("No handler for %s %s", apiId, arm.Service)
+					}
+				}
+				r = Split(srvName, apiId, arms, handlers, srvConf.SplitLocate)
+			}
+			var limits []namedLimit
+			if !apiKey.Limits.empty() {
+				limits = append(limits, namedLimit{"key:" + apiId, apiKey.Limits})
+			}
+			if !srvConf.Limits.empty() {
+				// Shared by every key, so it caps the service as a whole.
+				limits = append(limits, namedLimit{"srv:" + srvName, srvConf.Limits})
+			}
+			var paths = srvConf.Paths
+			if len(paths) == 0 {
+				paths = []string{""}
+			}
+			for _, vHost := range srvConf.VHost {
+				for _, vSysHost := range sysHost {
+					var vHost = vhostName(vHost, apiKey.ID, vSysHost)
+					var labels = reqLabels{resolved, vHost, apiId, services[resolved].Upstream.Scheme}
+					for _, prefix := range paths {
+						var h = r
+						if srvConf.StripPath {
+							h = RewritePath(prefix, srvConf.RewritePath, h)
+						}
+						rt.VHosts[vHost] = append(rt.VHosts[vHost], vhostInfo{vHost, prefix, srvName, resolved, apiId})
+						routes[vHost] = append(routes[vHost], pathRoute{prefix, AccessLog(labels, Instrument(labels,
+							TLSPolicy(srvConf, KeyAuth(apiId, apiKey, tokens, RateLimit(limits, h))),
+						))})
+					}
+				}
+			}
+		}
+	}
+
+	for vHost, vRoutes := range routes {
+		var h = vRoutes[0].Handler
+		if len(vRoutes) > 1 || vRoutes[0].Prefix != "" {
+			var ps, psErr = newPathSwitch(vHost, vRoutes)
+			if psErr != nil {
+				return nil, psErr
+			}
+			h = ps
+		}
+		if addErr := rt.Switch.add(vHost, h); addErr != nil {
+			return nil, addErr
+		}
+	}
+	return rt, nil
+}
+
+// serve counts the request against this generation so it can be drained
+// once a newer one has been swapped in.
+func (rt *Router) serve(h http.Handler, w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt64(&rt.active, 1)
+	atomic.AddInt64(&inflight, 1)
+	defer atomic.AddInt64(&rt.active, -1)
+	defer atomic.AddInt64(&inflight, -1)
+	h.ServeHTTP(w, r)
+}
+
+// drain waits for in-flight requests of a replaced generation and then drops
+// the idle upstream connections held by its reverse proxies.
+func (rt *Router) drain() {
+	var deadline = time.Now().Add(drainTimeout)
+	for atomic.LoadInt64(&rt.active) > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 100)
+	}
+	for _, rp := range rt.proxies {
+		if c, ok := rp.Transport.(interface{ CloseIdleConnections() }); ok {
+			c.CloseIdleConnections()
+		}
+	}
+}
+
+// LiveSwitch dispatches to the HostSwitch of the current generation.
+type LiveSwitch struct{}
+
+func (LiveSwitch) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var rt = currentRouter()
+	rt.serve(rt.Switch, w, r)
+}
+
+// skyVHost serves a vhost bound on skynet with whatever handler the current
+// generation has for it.
+func skyVHost(vHost string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var rt = currentRouter()
+		var h = rt.Switch.exact(vHost)
+		if h == nil {
+			http.NotFound(w, r)
+			return
+		}
+		rt.serve(h, w, r.WithContext(context.WithValue(r.Context(), ctxSkynet, true)))
+	}
+}
+
+// viaSkynet reports whether the request came in over a skynet binding rather
+// than one of the public listeners.
+func viaSkynet(r *http.Request) bool {
+	var sky, _ = r.Context().Value(ctxSkynet).(bool)
+	return sky
+}
+
+// reload rebuilds the routing state from the config file and environment,
+// swaps it in and brings the skynet bindings in line with the new vhosts.
+func reload() error {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	var services, apiKeys, confErr = loadConfig(*configPath, os.Environ())
+	if confErr != nil {
+		return confErr
+	}
+	var rt, rtErr = buildRouter(services, apiKeys)
+	if rtErr != nil {
+		return rtErr
+	}
+
+	// Wildcards and patterns can not be discovered in skynet, only the exact
+	// vhosts are bound, under the name they are configured with. A failed
+	// reload releases whatever it bound, keeping the previous generation's.
+	var bound []string
+	for vHost := range rt.VHosts {
+		if skyBinds[vHost] != nil || rt.Switch.exact(vHost) == nil {
+			continue
+		}
+		var skyL, skyLErr = skynet.Bind("", vHost)
+		if skyLErr != nil {
+			for _, b := range bound {
+				skyBinds[b].Close()
+				delete(skyBinds, b)
+			}
+			return fmt.Errorf("Failed while binding skynet to %s: %s", vHost, skyLErr)
+		}
+		skyBinds[vHost] = skyL
+		bound = append(bound, vHost)
+	}
+
+	var old = currentRouter()
+	current.Store(rt)
+
+	for vHost, skyL := range skyBinds {
+		if rt.VHosts[vHost] != nil {
+			if old == nil || old.VHosts[vHost] == nil {
+				go newServer("", skyVHost(vHost)).Serve(skyL)
+				log.Println("Serving HTTP and SHTTP for", vHost)
+			}
+			continue
+		}
+		skyL.Close()
+		delete(skyBinds, vHost)
+		log.Println("Stopped serving", vHost)
+	}
+
+	if old != nil {
+		go old.drain()
+	}
+	select {
+	case acmeKick <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// watchReload reloads on SIGHUP and whenever the config file modification
+// time changes.
+func watchReload(poll time.Duration) {
+	var hup = make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var lastMod time.Time
+	if fi, statErr := os.Stat(*configPath); statErr == nil {
+		lastMod = fi.ModTime()
+	}
+	var ticker = time.NewTicker(poll)
+	for {
+		select {
+		case <-hup:
+			log.Println("Reloading on SIGHUP")
+		case <-ticker.C:
+			if *configPath == "" {
+				continue
+			}
+			var fi, statErr = os.Stat(*configPath)
+			if statErr != nil || !fi.ModTime().After(lastMod) {
+				continue
+			}
+			lastMod = fi.ModTime()
+			log.Println("Reloading on change of", *configPath)
+		}
+		if reloadErr := reload(); reloadErr != nil {
+			log.Println("Reload failed, keeping previous config:", reloadErr)
+		}
+	}
+}
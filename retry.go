@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cenk/backoff"
+	"github.com/zenhotels/astranet/service"
+)
+
+// retryConf controls how a service retries upstream requests that failed
+// before any response header arrived. Only idempotent methods are retried
+// unless Body is set, in which case any request with a body small enough to
+// be buffered is.
+type retryConf struct {
+	Retries    int
+	TryTimeout time.Duration
+	Backoff    time.Duration
+	Body       bool
+}
+
+// retryBodyLimit caps how much of a request body is kept in memory to be
+// replayed; larger requests are sent once.
+var retryBodyLimit int64 = 1 << 20
+
+var errTryTimeout = errors.New("upstream try timed out")
+
+func idempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+// retryState travels in the request context so the dialer can skip the
+// instances earlier tries went to: skynet hosts in hex or upstream addresses.
+type retryState struct {
+	sync.Mutex
+	tried string
+}
+
+func (self *retryState) add(key string) {
+	self.Lock()
+	self.tried += "," + key + ","
+	self.Unlock()
+}
+
+func hostKey(host uint64) string {
+	return strconv.FormatUint(host, 16)
+}
+
+func (self *retryState) exclude() string {
+	self.Lock()
+	defer self.Unlock()
+	return self.tried
+}
+
+// excludeSelector picks among the instances listed in neither exclude nor
+// blocked, falling back to the excluded ones once every instance has been
+// tried and to the blocked ones only when nothing else is left. The lists are
+// strings so the selector stays usable as a discovery cache key.
+type excludeSelector struct {
+	next    service.Selector
+	exclude string
+	blocked string
+}
+
+func (self excludeSelector) Select(pool []service.ServiceInfo) (int, bool) {
+	var fresh, live []int
+	for i, srv := range pool {
+		var key = "," + hostKey(srv.Host) + ","
+		if strings.Contains(self.blocked, key) {
+			continue
+		}
+		live = append(live, i)
+		if !strings.Contains(self.exclude, key) {
+			fresh = append(fresh, i)
+		}
+	}
+	for _, idx := range [][]int{fresh, live} {
+		if len(idx) == len(pool) {
+			return self.next.Select(pool)
+		}
+		if len(idx) > 0 {
+			var left = make([]service.ServiceInfo, len(idx))
+			for i, j := range idx {
+				left[i] = pool[j]
+			}
+			var i, cache = self.next.Select(left)
+			return idx[i], cache
+		}
+	}
+	return self.next.Select(pool)
+}
+
+// retryTransport retries a request on RoundTrip errors only, that is before
+// any response header was received, so nothing has reached the client yet.
+type retryTransport struct {
+	conf retryConf
+	next http.RoundTripper
+}
+
+func (self retryTransport) CloseIdleConnections() {
+	if c, ok := self.next.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
+
+func (self retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var retries = self.conf.Retries
+	if !idempotent(req.Method) && !self.conf.Body {
+		retries = 0
+	}
+	var body []byte
+	if req.Body != nil && retries > 0 {
+		var buf, readErr = ioutil.ReadAll(io.LimitReader(req.Body, retryBodyLimit+1))
+		if readErr != nil {
+			return nil, readErr
+		}
+		if int64(len(buf)) > retryBodyLimit {
+			req.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(buf), req.Body), req.Body}
+			retries = 0
+		} else {
+			req.Body.Close()
+			body = buf
+		}
+	}
+
+	var ctx = req.Context()
+	if retries > 0 {
+		ctx = context.WithValue(ctx, ctxRetry, &retryState{})
+	}
+	var wait = backoff.NewExponentialBackOff()
+	wait.InitialInterval = self.conf.Backoff
+	wait.MaxElapsedTime = 0
+	wait.Reset()
+	for try := 0; ; try++ {
+		var out = req.WithContext(ctx)
+		if body != nil {
+			out.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		var resp, err = self.try(out)
+		if err == nil || try >= retries || req.Context().Err() != nil {
+			return resp, err
+		}
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(wait.NextBackOff()):
+		}
+	}
+}
+
+// try bounds a single attempt by TryTimeout until the response headers
+// arrive.
+func (self retryTransport) try(req *http.Request) (*http.Response, error) {
+	if self.conf.TryTimeout == 0 {
+		return self.next.RoundTrip(req)
+	}
+	return roundTripWithin(self.next, req, self.conf.TryTimeout, errTryTimeout)
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cenk/backoff"
+)
+
+// Seed peers come from SKYNET_SEEDS (comma separated host:port list),
+// SKYNET_SEEDS_SRV (a DNS SRV name) and SKYNET_SEEDS_FILE (one host:port per
+// line). They are re-resolved every seedRefresh.
+var seedStatic = os.Getenv("SKYNET_SEEDS")
+var seedSRV = os.Getenv("SKYNET_SEEDS_SRV")
+var seedFile = os.Getenv("SKYNET_SEEDS_FILE")
+
+var seedRefresh = time.Minute
+
+var errLinkDropped = errors.New("link dropped")
+
+type seedStatus struct {
+	Addr     string    `json:"addr"`
+	Source   string    `json:"source"`
+	State    string    `json:"state"`
+	Since    time.Time `json:"since"`
+	Attempts int       `json:"attempts"`
+	Peer     string    `json:"peer,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+type seedPeer struct {
+	sync.Mutex
+	status seedStatus
+	conn   net.Conn
+	stop   chan struct{}
+}
+
+var seeds = struct {
+	sync.Mutex
+	m    map[string]*seedPeer
+	left bool
+}{m: map[string]*seedPeer{}}
+
+func (self *seedPeer) set(state string, err error) {
+	self.Lock()
+	self.status.State = state
+	self.status.Since = time.Now().UTC()
+	self.status.Error = ""
+	if err != nil {
+		self.status.Error = err.Error()
+	}
+	self.Unlock()
+}
+
+// run keeps a link to the seed attached to skynet, dialing again with
+// exponential backoff whenever it cannot connect or the link drops.
+func (self *seedPeer) run() {
+	var retry = backoff.NewExponentialBackOff()
+	retry.MaxElapsedTime = 0
+	retry.MaxInterval = time.Minute
+
+	for {
+		self.Lock()
+		self.status.Attempts++
+		self.Unlock()
+		self.set("connecting", nil)
+
+		var conn, dialErr = skynetDial(self.status.Addr)
+		if dialErr == nil {
+			self.Lock()
+			self.conn = conn
+			self.status.Peer = peerName(conn)
+			self.Unlock()
+			self.set("connected", nil)
+
+			var linked = time.Now()
+			skynet.Attach(conn)
+			conn.Close()
+			if time.Since(linked) > retry.MaxInterval {
+				retry.Reset()
+			}
+			dialErr = errLinkDropped
+		}
+
+		var wait = retry.NextBackOff()
+		self.set("backoff", dialErr)
+		select {
+		case <-self.stop:
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (self *seedPeer) close() {
+	close(self.stop)
+	self.Lock()
+	if self.conn != nil {
+		self.conn.Close()
+	}
+	self.Unlock()
+}
+
+// The last successful lookups of the seed hosts and of SKYNET_SEEDS_SRV,
+// used by joinSeeds only. A failed lookup falls back to them so a resolver
+// hiccup does not tear the mesh links down.
+var seedAddrs = map[string][]string{}
+var seedSRVTargets []string
+
+// resolveSeeds returns the seed addresses mapped to where they came from.
+func resolveSeeds() map[string]string {
+	var found = map[string]string{}
+	var addHostPort = func(hp, source string) {
+		var host, port, hpErr = net.SplitHostPort(hp)
+		if hpErr != nil {
+			log.Println("Skipping seed", hp, hpErr)
+			return
+		}
+		var addrs, lookupErr = net.LookupHost(host)
+		if lookupErr != nil {
+			addrs = seedAddrs[hp]
+			log.Println("Error while resolving seed", hp, lookupErr, "keeping", addrs)
+		}
+		seedAddrs[hp] = addrs
+		for _, a := range addrs {
+			found[net.JoinHostPort(a, port)] = source
+		}
+	}
+
+	for _, hp := range strings.Split(seedStatic, ",") {
+		if hp = strings.TrimSpace(hp); hp != "" {
+			addHostPort(hp, "static")
+		}
+	}
+	if seedSRV != "" {
+		var _, srvs, srvErr = net.LookupSRV("", "", seedSRV)
+		if srvErr != nil {
+			log.Println("Error while SKYNET_SEEDS_SRV lookup", srvErr)
+		} else {
+			seedSRVTargets = seedSRVTargets[:0]
+			for _, srv := range srvs {
+				seedSRVTargets = append(seedSRVTargets, net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), strconv.Itoa(int(srv.Port))))
+			}
+		}
+		for _, hp := range seedSRVTargets {
+			addHostPort(hp, "srv")
+		}
+	}
+	if seedFile != "" {
+		var f, openErr = os.Open(seedFile)
+		if openErr != nil {
+			log.Println("Error while SKYNET_SEEDS_FILE reading", openErr)
+		} else {
+			var sc = bufio.NewScanner(f)
+			for sc.Scan() {
+				if hp := strings.TrimSpace(sc.Text()); hp != "" && !strings.HasPrefix(hp, "#") {
+					addHostPort(hp, "file")
+				}
+			}
+			f.Close()
+		}
+	}
+	return found
+}
+
+// joinSeeds starts a link per resolved seed and keeps the set in line with
+// DNS and the seed file, dropping links to seeds that went away.
+func joinSeeds() {
+	if seedStatic == "" && seedSRV == "" && seedFile == "" {
+		return
+	}
+	for {
+		var found = resolveSeeds()
+		seeds.Lock()
+		if seeds.left {
+			seeds.Unlock()
+			return
+		}
+		for a, source := range found {
+			if seeds.m[a] != nil {
+				continue
+			}
+			var peer = &seedPeer{stop: make(chan struct{})}
+			peer.status.Addr, peer.status.Source = a, source
+			seeds.m[a] = peer
+			log.Println("Joining skynet seed", a, "from", source)
+			go peer.run()
+		}
+		for a, peer := range seeds.m {
+			if _, ok := found[a]; !ok {
+				log.Println("Leaving skynet seed", a)
+				peer.close()
+				delete(seeds.m, a)
+			}
+		}
+		seeds.Unlock()
+		time.Sleep(seedRefresh)
+	}
+}
+
+// leaveSeeds drops the links to every seed for good.
+func leaveSeeds() {
+	seeds.Lock()
+	seeds.left = true
+	for a, peer := range seeds.m {
+		log.Println("Leaving skynet seed", a)
+		peer.close()
+		delete(seeds.m, a)
+	}
+	seeds.Unlock()
+}
+
+func seedStatuses() []seedStatus {
+	var res = []seedStatus{}
+	seeds.Lock()
+	for _, peer := range seeds.m {
+		peer.Lock()
+		res = append(res, peer.status)
+		peer.Unlock()
+	}
+	seeds.Unlock()
+	sort.Slice(res, func(i, j int) bool { return res[i].Addr < res[j].Addr })
+	return res
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var shutdownTimeout = time.Second * 30
+
+// inflight counts requests being proxied across all generations and both the
+// TCP and skynet listeners.
+var inflight int64
+
+// extraBinds are skynet listeners outside the vhost table, and the one taking
+// skynet links on SKYNET_PORT, which are closed last on shutdown.
+var extraBinds []net.Listener
+
+func init() {
+	if v := os.Getenv("SHUTDOWN_TIMEOUT"); v != "" {
+		var d, dErr = time.ParseDuration(v)
+		if dErr != nil {
+			log.Panicln("Error while SHUTDOWN_TIMEOUT parsing", dErr)
+		}
+		shutdownTimeout = d
+	}
+}
+
+// waitShutdown blocks until SIGTERM or SIGINT and then drains the endpoint:
+// vhosts are unbound from skynet so peers stop routing here, the HTTP servers
+// stop accepting, and in-flight requests get up to shutdownTimeout to finish.
+func waitShutdown(servers ...*http.Server) {
+	var sig = make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+	log.Println("Shutting down on", <-sig)
+	atomic.StoreInt32(&draining, 1)
+
+	var ctx, cancel = context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	// reloadLock stays held so that no reload binds vhosts again.
+	reloadLock.Lock()
+	for vHost, skyL := range skyBinds {
+		skyL.Close()
+		delete(skyBinds, vHost)
+	}
+
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if shutErr := srv.Shutdown(ctx); shutErr != nil {
+				log.Println("HTTP shutdown:", shutErr)
+			}
+		}(srv)
+	}
+	wg.Wait()
+
+	for atomic.LoadInt64(&inflight) > 0 && ctx.Err() == nil {
+		time.Sleep(time.Millisecond * 100)
+	}
+	if n := atomic.LoadInt64(&inflight); n > 0 {
+		log.Println("Shutdown deadline reached with", n, "requests in flight")
+	}
+
+	for _, skyL := range extraBinds {
+		skyL.Close()
+	}
+	leaveSeeds()
+}
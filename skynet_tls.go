@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// Skynet links are wrapped in mutual TLS when SKYNET_TLS_CERT and
+// SKYNET_TLS_KEY are set. Both ends must present a certificate signed by
+// SKYNET_TLS_CA and, when SKYNET_TLS_PEERS is set, carry one of the listed
+// names as CN or DNS name. Every node of the mesh has to run with wrapping,
+// as astranet itself only knows how to join and listen in cleartext.
+var skyTLSCert = os.Getenv("SKYNET_TLS_CERT")
+var skyTLSKey = os.Getenv("SKYNET_TLS_KEY")
+var skyTLSCA = os.Getenv("SKYNET_TLS_CA")
+var skyTLSPeers = os.Getenv("SKYNET_TLS_PEERS")
+
+var skyTLS *tls.Config
+
+var skyHandshakeTimeout = time.Second * 10
+
+// setupSkynetTLS loads the link certificates. It must run before skynet is
+// first used, since MPXROUTER and SKYNET_BIND would otherwise be joined and
+// served by astranet in cleartext; MPXROUTER is taken over as a seed instead.
+func setupSkynetTLS() error {
+	if skyTLSCert == "" && skyTLSKey == "" {
+		return nil
+	}
+	if skyTLSCert == "" || skyTLSKey == "" || skyTLSCA == "" {
+		return errors.New("SKYNET_TLS_CERT, SKYNET_TLS_KEY and SKYNET_TLS_CA must be set together")
+	}
+	if os.Getenv("SKYNET_BIND") != "" {
+		return errors.New("SKYNET_BIND is not supported with SKYNET_TLS_CERT, use SKYNET_PORT")
+	}
+	var cert, certErr = tls.LoadX509KeyPair(skyTLSCert, skyTLSKey)
+	if certErr != nil {
+		return fmt.Errorf("Error while SKYNET_TLS_CERT loading: %s", certErr)
+	}
+	var caPEM, caErr = ioutil.ReadFile(skyTLSCA)
+	if caErr != nil {
+		return fmt.Errorf("Error while SKYNET_TLS_CA loading: %s", caErr)
+	}
+	var pool = x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return fmt.Errorf("No certificates found in %s", skyTLSCA)
+	}
+	var peers = map[string]bool{}
+	for _, p := range strings.Split(skyTLSPeers, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			peers[strings.ToLower(p)] = true
+		}
+	}
+
+	// Peers are dialed by address, so the chain and the identity are checked
+	// by verifyPeer on both ends rather than by the hostname verification.
+	skyTLS = &tls.Config{
+		Certificates:       []tls.Certificate{cert},
+		ClientAuth:         tls.RequireAnyClientCert,
+		InsecureSkipVerify: true,
+		MinVersion:         tls.VersionTLS12,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyPeer(pool, peers, rawCerts)
+		},
+	}
+
+	if router := os.Getenv("MPXROUTER"); router != "" {
+		os.Unsetenv("MPXROUTER")
+		seedStatic = strings.Trim(seedStatic+","+router, ",")
+	}
+	return nil
+}
+
+func verifyPeer(pool *x509.CertPool, peers map[string]bool, rawCerts [][]byte) error {
+	if len(rawCerts) == 0 {
+		return errors.New("no peer certificate")
+	}
+	var chain = make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		var c, parseErr = x509.ParseCertificate(raw)
+		if parseErr != nil {
+			return parseErr
+		}
+		chain[i] = c
+	}
+	var opts = x509.VerifyOptions{
+		Roots:         pool,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}
+	for _, c := range chain[1:] {
+		opts.Intermediates.AddCert(c)
+	}
+	if _, verifyErr := chain[0].Verify(opts); verifyErr != nil {
+		return verifyErr
+	}
+	if len(peers) == 0 {
+		return nil
+	}
+	for _, name := range append([]string{chain[0].Subject.CommonName}, chain[0].DNSNames...) {
+		if peers[strings.ToLower(name)] {
+			return nil
+		}
+	}
+	return fmt.Errorf("peer %q is not in SKYNET_TLS_PEERS", chain[0].Subject.CommonName)
+}
+
+// peerName is the CN of the certificate the other end of a link presented.
+func peerName(conn net.Conn) string {
+	var tlsConn, ok = conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+	var state = tlsConn.ConnectionState()
+	if len(state.PeerCertificates) == 0 {
+		return ""
+	}
+	return state.PeerCertificates[0].Subject.CommonName
+}
+
+// skynetListenAndServe accepts skynet links on address, wrapping them in
+// mutual TLS when configured. The listener is returned so shutdown can close
+// it, which astranet's own ListenAndServe does not allow; unlike that one it
+// does not announce the port to linked peers, so nodes find each other
+// through their seeds.
+func skynetListenAndServe(network, address string) (net.Listener, error) {
+	var l, lErr = net.Listen(network, address)
+	if lErr != nil {
+		return nil, lErr
+	}
+	if skyTLS != nil {
+		l = tls.NewListener(l, skyTLS)
+		log.Println("Serving skynet over mutual TLS on", address)
+	}
+	go func() {
+		for {
+			var conn, connErr = l.Accept()
+			if connErr != nil {
+				log.Println("Skynet listener stopped", connErr)
+				return
+			}
+			if tlsConn, ok := conn.(*tls.Conn); ok {
+				go skynetAccept(tlsConn)
+				continue
+			}
+			go skynet.Attach(conn)
+		}
+	}()
+	return l, nil
+}
+
+func skynetAccept(conn *tls.Conn) {
+	conn.SetDeadline(time.Now().Add(skyHandshakeTimeout))
+	if hsErr := conn.Handshake(); hsErr != nil {
+		log.Println("Rejected skynet peer", conn.RemoteAddr(), hsErr)
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	log.Println("Skynet peer", peerName(conn), "linked from", conn.RemoteAddr())
+	skynet.Attach(conn)
+	conn.Close()
+}
+
+// skynetDial opens a link to a skynet peer, completing the TLS handshake
+// before astranet gets the connection.
+func skynetDial(address string) (net.Conn, error) {
+	var dialer = &net.Dialer{Timeout: time.Second * 10}
+	if skyTLS == nil {
+		return dialer.Dial("tcp4", address)
+	}
+	dialer.Timeout = dialer.Timeout + skyHandshakeTimeout
+	return tls.DialWithDialer(dialer, "tcp4", address, skyTLS)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// splitArm sends Weight parts of the traffic of a split to Service.
+type splitArm struct {
+	Service string
+	Weight  int
+}
+
+type splitArms []splitArm
+
+func (self splitArms) String() string {
+	var parts = make([]string, len(self))
+	for i, arm := range self {
+		parts[i] = arm.Service + "=" + strconv.Itoa(arm.Weight)
+	}
+	return strings.Join(parts, ",")
+}
+
+// parseSplit reads the SPLIT format, services with their weights in order,
+// e.g. "BOOKING=95,BOOKINGV2=5".
+func parseSplit(value string) (splitArms, error) {
+	var arms splitArms
+	var total = 0
+	for _, part := range strings.Split(value, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		var eq = strings.IndexByte(part, '=')
+		if eq < 0 {
+			return nil, fmt.Errorf("missing weight for %q", part)
+		}
+		var weight, wErr = strconv.Atoi(strings.TrimSpace(part[eq+1:]))
+		if wErr != nil || weight < 0 {
+			return nil, fmt.Errorf("bad weight of %q", part)
+		}
+		arms = append(arms, splitArm{strings.TrimSpace(part[:eq]), weight})
+		total += weight
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("no weight in %q", value)
+	}
+	return arms, nil
+}
+
+// pickArm picks the arm of a keyed request by weighted rendezvous hashing:
+// every arm scores the key and the best score wins. A change of weight only
+// moves clients to the arm whose weight was raised, or away from the one
+// whose weight was lowered; the clients of the other arms stay where they
+// are.
+func pickArm(srvName, key string, arms splitArms) int {
+	var best, bestScore = 0, math.Inf(-1)
+	for i, arm := range arms {
+		if arm.Weight == 0 {
+			continue
+		}
+		var sum = sha256.Sum256([]byte(srvName + ":" + arm.Service + ":" + key))
+		var h = binary.BigEndian.Uint64(sum[:]) >> 11
+		var score = -float64(arm.Weight) / math.Log((float64(h)+0.5)/(1<<53))
+		if score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+	return best
+}
+
+// Split spreads the requests to srvName over the handlers of its arms by
+// weight. Requests carrying a key found by locate always land on the same
+// arm, picked by pickArm, and requests without one are spread at random.
+func Split(srvName, apiId string, arms splitArms, handlers []http.Handler, locate func(*http.Request) string) http.Handler {
+	var total = 0
+	for _, arm := range arms {
+		total += arm.Weight
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var i = 0
+		if key := locate(r); key != "" {
+			i = pickArm(srvName, key, arms)
+		} else {
+			var bucket = rand.Intn(total)
+			for bucket >= arms[i].Weight {
+				bucket -= arms[i].Weight
+				i++
+			}
+		}
+		var sw = &statusWriter{passWriter: passWriter{w}}
+		handlers[i].ServeHTTP(sw, r)
+		metrics.GetOrRegisterCounter(fmt.Sprintf(
+			"api_endpoint_split_requests_total{service=%q,api_key=%q,arm=%q,code=\"%d\"}",
+			srvName, apiId, arms[i].Service, sw.Status(),
+		), metricsRegistry).Inc(1)
+	})
+}
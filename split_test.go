@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestParseSplit(t *testing.T) {
+	var tests = []struct {
+		value string
+		want  string
+		ok    bool
+	}{
+		{"BOOKING=95,BOOKINGV2=5", "BOOKING=95,BOOKINGV2=5", true},
+		{" A = 1 , ,B=0", "A=1,B=0", true},
+		{"A", "", false},
+		{"A=x", "", false},
+		{"A=-1,B=2", "", false},
+		{"A=0,B=0", "", false},
+	}
+	for _, tt := range tests {
+		var arms, err = parseSplit(tt.value)
+		if (err == nil) != tt.ok || (tt.ok && arms.String() != tt.want) {
+			t.Errorf("parseSplit(%q) = %v, %v; want %q", tt.value, arms, err, tt.want)
+		}
+	}
+}
+
+// armsOf places keys on the arms of a split.
+func armsOf(arms splitArms, keys int) []string {
+	var res = make([]string, keys)
+	for k := range res {
+		res[k] = arms[pickArm("BOOKING", "client"+strconv.Itoa(k), arms)].Service
+	}
+	return res
+}
+
+func TestPickArmShares(t *testing.T) {
+	const keys = 20000
+	var counts = map[string]int{}
+	for _, arm := range armsOf(splitArms{{"A", 90}, {"B", 5}, {"C", 5}, {"D", 0}}, keys) {
+		counts[arm]++
+	}
+	for arm, share := range map[string]float64{"A": 0.90, "B": 0.05, "C": 0.05, "D": 0} {
+		if got := float64(counts[arm]) / keys; got < share-0.01 || got > share+0.01 {
+			t.Errorf("arm %s got %.3f of the keys, want %.2f", arm, got, share)
+		}
+	}
+}
+
+func TestPickArmSticky(t *testing.T) {
+	const keys = 20000
+	var base = splitArms{{"A", 90}, {"B", 5}, {"C", 5}}
+	var before = armsOf(base, keys)
+
+	// Changing the weight of one arm, wherever it is in the list, only moves
+	// clients between that arm and the others.
+	var tests = []struct {
+		arms    splitArms
+		changed string
+	}{
+		{splitArms{{"A", 90}, {"B", 10}, {"C", 5}}, "B"},
+		{splitArms{{"A", 90}, {"B", 1}, {"C", 5}}, "B"},
+		{splitArms{{"A", 95}, {"B", 5}, {"C", 5}}, "A"},
+		{splitArms{{"A", 90}, {"B", 5}, {"C", 20}}, "C"},
+		{splitArms{{"A", 90}, {"B", 0}, {"C", 5}}, "B"},
+	}
+	for _, tt := range tests {
+		var after = armsOf(tt.arms, keys)
+		var moved = 0
+		for k := range after {
+			if before[k] == after[k] {
+				continue
+			}
+			moved++
+			if before[k] != tt.changed && after[k] != tt.changed {
+				t.Errorf("%v: key %d moved from %s to %s", tt.arms, k, before[k], after[k])
+				break
+			}
+		}
+		if moved == 0 {
+			t.Errorf("%v: no key moved", tt.arms)
+		}
+	}
+}
+
+func TestSplit(t *testing.T) {
+	var arms = splitArms{{"A", 1}, {"B", 1}}
+	var handlers = make([]http.Handler, len(arms))
+	for i, arm := range arms {
+		var name = arm.Service
+		handlers[i] = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		})
+	}
+	var h = Split("TEST", "common", arms, handlers, HeaderValue("X-User"))
+
+	var seen = map[string]bool{}
+	for k := 0; k < 100; k++ {
+		var user = "user" + strconv.Itoa(k)
+		var first string
+		for try := 0; try < 3; try++ {
+			var req = httptest.NewRequest("GET", "/", nil)
+			req.Header.Set("X-User", user)
+			var rec = httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if try == 0 {
+				first = rec.Body.String()
+			} else if rec.Body.String() != first {
+				t.Fatalf("%s went to %s and then to %s", user, first, rec.Body.String())
+			}
+		}
+		seen[first] = true
+	}
+	if !seen["A"] || !seen["B"] {
+		t.Errorf("keys only reached %v", seen)
+	}
+}
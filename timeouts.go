@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// Server side timeouts of every listener, TCP and skynet alike.
+var readHeaderTimeout = time.Second * 10
+var idleTimeout = time.Minute * 2
+
+func init() {
+	for name, d := range map[string]*time.Duration{
+		"READ_HEADER_TIMEOUT": &readHeaderTimeout,
+		"IDLE_TIMEOUT":        &idleTimeout,
+	} {
+		if v := os.Getenv(name); v != "" {
+			var parsed, dErr = time.ParseDuration(v)
+			if dErr != nil {
+				log.Panicln("Error while", name, "parsing", dErr)
+			}
+			*d = parsed
+		}
+	}
+}
+
+func newServer(addr string, h http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           h,
+		ReadHeaderTimeout: readHeaderTimeout,
+		IdleTimeout:       idleTimeout,
+	}
+}
+
+// timeoutConf bounds a service's upstream exchange. Request covers everything
+// up to the response headers, retries included, ResponseHeader the wait for
+// headers once a request was written, Idle the gap between reads of the
+// response body and MaxDuration the whole request.
+type timeoutConf struct {
+	Request        time.Duration
+	ResponseHeader time.Duration
+	Idle           time.Duration
+	MaxDuration    time.Duration
+}
+
+var errRequestTimeout = errors.New("upstream request timed out")
+var errIdleTimeout = errors.New("upstream response idle timed out")
+
+// timedOut travels in the request context and is set once a timeout cut the
+// upstream exchange short, so the 502 the proxy reports becomes a 504.
+type timedOut struct {
+	flag int32
+}
+
+func (self *timedOut) set() {
+	atomic.StoreInt32(&self.flag, 1)
+}
+
+func (self *timedOut) isSet() bool {
+	return atomic.LoadInt32(&self.flag) == 1
+}
+
+func isTimeout(err error) bool {
+	if err == errTryTimeout || err == errRequestTimeout || err == context.DeadlineExceeded {
+		return true
+	}
+	var netErr, ok = err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+// roundTripWithin bounds next.RoundTrip by d until the response headers
+// arrive; reading the body is left to the request context.
+func roundTripWithin(next http.RoundTripper, req *http.Request, d time.Duration, timeoutErr error) (*http.Response, error) {
+	var ctx, cancel = context.WithCancel(req.Context())
+	var timer = time.AfterFunc(d, cancel)
+	var resp, err = next.RoundTrip(req.WithContext(ctx))
+	if !timer.Stop() {
+		if err == nil {
+			resp.Body.Close()
+		}
+		cancel()
+		return nil, timeoutErr
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = cancelBody{resp.Body, cancel}
+	return resp, nil
+}
+
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (self cancelBody) Close() error {
+	var err = self.ReadCloser.Close()
+	self.cancel()
+	return err
+}
+
+// idleBody aborts the response once no data arrived for the idle timeout.
+type idleBody struct {
+	io.ReadCloser
+	timer *time.Timer
+	idle  time.Duration
+	fired int32
+}
+
+func (self *idleBody) Read(p []byte) (int, error) {
+	var n, err = self.ReadCloser.Read(p)
+	if atomic.LoadInt32(&self.fired) == 1 {
+		return n, errIdleTimeout
+	}
+	self.timer.Reset(self.idle)
+	return n, err
+}
+
+func (self *idleBody) Close() error {
+	self.timer.Stop()
+	return self.ReadCloser.Close()
+}
+
+// timeoutTransport applies the Request and Idle timeouts and flags timeouts
+// for Deadline. It wraps the retries so Request spans all tries.
+type timeoutTransport struct {
+	conf timeoutConf
+	next http.RoundTripper
+}
+
+func (self timeoutTransport) CloseIdleConnections() {
+	if c, ok := self.next.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
+
+func (self timeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var resp *http.Response
+	var err error
+	if self.conf.Request > 0 {
+		resp, err = roundTripWithin(self.next, req, self.conf.Request, errRequestTimeout)
+	} else {
+		resp, err = self.next.RoundTrip(req)
+	}
+	if err != nil {
+		if flag, ok := req.Context().Value(ctxTimeout).(*timedOut); ok && isTimeout(err) {
+			flag.set()
+		}
+		return nil, err
+	}
+	if self.conf.Idle > 0 {
+		var body = &idleBody{ReadCloser: resp.Body, idle: self.conf.Idle}
+		body.timer = time.AfterFunc(self.conf.Idle, func() {
+			atomic.StoreInt32(&body.fired, 1)
+			body.ReadCloser.Close()
+		})
+		resp.Body = body
+	}
+	return resp, nil
+}
+
+// timeoutWriter turns the proxy's 502 into 504 when a timeout caused it.
+type timeoutWriter struct {
+	passWriter
+	ctx  context.Context
+	flag *timedOut
+}
+
+func (self *timeoutWriter) WriteHeader(code int) {
+	if code == http.StatusBadGateway && (self.flag.isSet() || self.ctx.Err() == context.DeadlineExceeded) {
+		code = http.StatusGatewayTimeout
+	}
+	self.ResponseWriter.WriteHeader(code)
+}
+
+// Deadline caps the whole request at MaxDuration and answers 504 Gateway
+// Timeout when any of the service timeouts fired before the response began.
+func Deadline(c timeoutConf, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var flag = &timedOut{}
+		var ctx = context.WithValue(r.Context(), ctxTimeout, flag)
+		if c.MaxDuration > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, c.MaxDuration)
+			defer cancel()
+		}
+		next.ServeHTTP(&timeoutWriter{passWriter{w}, ctx, flag}, r.WithContext(ctx))
+	})
+}
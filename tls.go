@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var httpsPort = os.Getenv("HTTPS_PORT")
+var certDir = os.Getenv("TLS_CERT_DIR")
+
+// certStore holds the certificates of TLS_CERT_DIR indexed by the DNS names
+// they cover. Each <name>.crt is paired with <name>.key.
+type certStore struct {
+	sync.RWMutex
+	byName  map[string]*tls.Certificate
+	modTime map[string]time.Time
+}
+
+var certs = &certStore{}
+
+func (self *certStore) load(dir string) error {
+	var crtFiles, globErr = filepath.Glob(filepath.Join(dir, "*.crt"))
+	if globErr != nil {
+		return globErr
+	}
+	var byName = map[string]*tls.Certificate{}
+	var modTime = map[string]time.Time{}
+	for _, crtFile := range crtFiles {
+		var keyFile = strings.TrimSuffix(crtFile, ".crt") + ".key"
+		var cert, loadErr = tls.LoadX509KeyPair(crtFile, keyFile)
+		if loadErr != nil {
+			return fmt.Errorf("Error while loading %s: %s", crtFile, loadErr)
+		}
+		var leaf, parseErr = x509.ParseCertificate(cert.Certificate[0])
+		if parseErr != nil {
+			return fmt.Errorf("Error while parsing %s: %s", crtFile, parseErr)
+		}
+		cert.Leaf = leaf
+		var names = leaf.DNSNames
+		if len(names) == 0 && leaf.Subject.CommonName != "" {
+			names = []string{leaf.Subject.CommonName}
+		}
+		for _, name := range names {
+			byName[strings.ToLower(name)] = &cert
+		}
+		for _, f := range []string{crtFile, keyFile} {
+			if fi, statErr := os.Stat(f); statErr == nil {
+				modTime[f] = fi.ModTime()
+			}
+		}
+	}
+
+	self.Lock()
+	self.byName, self.modTime = byName, modTime
+	self.Unlock()
+	return nil
+}
+
+// changed reports whether any certificate or key in dir was added, removed or
+// modified since the last load.
+func (self *certStore) changed(dir string) bool {
+	var files, _ = filepath.Glob(filepath.Join(dir, "*.crt"))
+	var keys, _ = filepath.Glob(filepath.Join(dir, "*.key"))
+	files = append(files, keys...)
+
+	self.RLock()
+	defer self.RUnlock()
+	if len(files) != len(self.modTime) {
+		return true
+	}
+	for _, f := range files {
+		var fi, statErr = os.Stat(f)
+		if statErr != nil || !fi.ModTime().Equal(self.modTime[f]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (self *certStore) watch(dir string, poll time.Duration) {
+	for range time.Tick(poll) {
+		if !self.changed(dir) {
+			continue
+		}
+		if loadErr := self.load(dir); loadErr != nil {
+			log.Println("Certificate reload failed, keeping previous ones:", loadErr)
+			continue
+		}
+		log.Println("Reloaded certificates from", dir)
+	}
+}
+
+// lookup finds the certificate for name, falling back to a wildcard one
+// covering its parent domain.
+func (self *certStore) lookup(name string) *tls.Certificate {
+	self.RLock()
+	defer self.RUnlock()
+	if cert := self.byName[name]; cert != nil {
+		return cert
+	}
+	if dot := strings.IndexByte(name, '.'); dot > 0 {
+		return self.byName["*"+name[dot:]]
+	}
+	return nil
+}
+
+// GetCertificate picks the certificate by SNI for hosts the current HostSwitch
+// would route.
+func (self *certStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	var name = strings.ToLower(hello.ServerName)
+	if currentRouter().Switch.Lookup(name) == nil {
+		return nil, fmt.Errorf("no vhost for %q", name)
+	}
+	if cert := self.lookup(name); cert != nil {
+		return cert, nil
+	}
+	return nil, fmt.Errorf("no certificate for %q", name)
+}
+
+// TLSPolicy applies the per service HTTPS settings to requests coming through
+// the public listeners: plain HTTP is redirected when TLSRedirect is set and
+// HTTPS responses carry Strict-Transport-Security when HSTS is set.
+func TLSPolicy(c reverseConf, next http.Handler) http.Handler {
+	if !c.TLSRedirect && c.HSTS == 0 {
+		return next
+	}
+	var hsts = "max-age=" + strconv.FormatInt(int64(c.HSTS.Seconds()), 10)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if viaSkynet(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.TLS == nil && c.TLSRedirect && httpsPort != "" {
+			var host, _, hpErr = net.SplitHostPort(r.Host)
+			if hpErr != nil {
+				host = r.Host
+			}
+			if httpsPort != "443" {
+				host = net.JoinHostPort(host, httpsPort)
+			}
+			http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+			return
+		}
+		if r.TLS != nil && c.HSTS > 0 {
+			w.Header().Set("Strict-Transport-Security", hsts)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+// upstreamTLSConf configures the connections to https upstreams. CA is a PEM
+// bundle trusted instead of the system roots, ServerName the name sent and
+// verified instead of the upstream hostname, Cert and Key an optional client
+// certificate and MinVersion the lowest TLS version accepted.
+type upstreamTLSConf struct {
+	CA         string
+	ServerName string
+	Cert       string
+	Key        string
+	MinVersion string
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func (self upstreamTLSConf) empty() bool {
+	return self == upstreamTLSConf{}
+}
+
+func (self upstreamTLSConf) config() (*tls.Config, error) {
+	var conf = &tls.Config{ServerName: self.ServerName, MinVersion: tls.VersionTLS12}
+	if self.MinVersion != "" {
+		var version, found = tlsVersions[self.MinVersion]
+		if !found {
+			return nil, fmt.Errorf("unknown TLS version %s", self.MinVersion)
+		}
+		conf.MinVersion = version
+	}
+	if self.CA != "" {
+		var caPEM, caErr = ioutil.ReadFile(self.CA)
+		if caErr != nil {
+			return nil, caErr
+		}
+		conf.RootCAs = x509.NewCertPool()
+		if !conf.RootCAs.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("No certificates found in %s", self.CA)
+		}
+	}
+	if self.Cert != "" || self.Key != "" {
+		if self.Cert == "" || self.Key == "" {
+			return nil, errors.New("client certificate and key must be set together")
+		}
+		var cert, certErr = tls.LoadX509KeyPair(self.Cert, self.Key)
+		if certErr != nil {
+			return nil, certErr
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	return conf, nil
+}
+
+// dialUpstreamTLS returns the TLS dialer of an https service. Balanced
+// requests are addressed by IP, so unless a server name is configured the
+// hostname of the upstream the address was resolved from is sent and
+// verified.
+func dialUpstreamTLS(conf *tls.Config, dialer *net.Dialer, bal *balancer) func(lnet, laddr string) (net.Conn, error) {
+	return func(lnet, laddr string) (net.Conn, error) {
+		var conn, dialErr = dialer.Dial(lnet, laddr)
+		if dialErr != nil {
+			return nil, dialErr
+		}
+		var c = conf.Clone()
+		if c.ServerName == "" {
+			c.ServerName = bal.serverName(laddr)
+		}
+		var tlsConn = tls.Client(conn, c)
+		if dialer.Timeout > 0 {
+			tlsConn.SetDeadline(time.Now().Add(dialer.Timeout))
+		}
+		if hsErr := tlsConn.Handshake(); hsErr != nil {
+			conn.Close()
+			return nil, hsErr
+		}
+		tlsConn.SetDeadline(time.Time{})
+		return tlsConn, nil
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert issues a certificate for cn signed by parent, self-signed when
+// parent is nil, and writes it and its key as PEM files into dir.
+func testCert(t *testing.T, dir, cn string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, dnsNames ...string) (*x509.Certificate, *ecdsa.PrivateKey, string, string) {
+	var key, keyErr = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if keyErr != nil {
+		t.Fatal(keyErr)
+	}
+	var tmpl = &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+		parent, parentKey = tmpl, key
+	}
+	var der, certErr = x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if certErr != nil {
+		t.Fatal(certErr)
+	}
+	var cert, parseErr = x509.ParseCertificate(der)
+	if parseErr != nil {
+		t.Fatal(parseErr)
+	}
+	var keyDER, marshalErr = x509.MarshalECPrivateKey(key)
+	if marshalErr != nil {
+		t.Fatal(marshalErr)
+	}
+	var certFile, keyFile = filepath.Join(dir, cn+".crt"), filepath.Join(dir, cn+".key")
+	if wErr := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); wErr != nil {
+		t.Fatal(wErr)
+	}
+	if wErr := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); wErr != nil {
+		t.Fatal(wErr)
+	}
+	return cert, key, certFile, keyFile
+}
+
+func TestDialUpstreamTLS(t *testing.T) {
+	var dir, dirErr = ioutil.TempDir("", "upstream_tls")
+	if dirErr != nil {
+		t.Fatal(dirErr)
+	}
+	defer os.RemoveAll(dir)
+
+	var ca, caKey, caFile, _ = testCert(t, dir, "ca", nil, nil)
+	var _, _, srvCert, srvKey = testCert(t, dir, "server", ca, caKey, "api.partner.test")
+	var _, _, clientCert, clientKey = testCert(t, dir, "client", ca, caKey)
+
+	var srvPair, pairErr = tls.LoadX509KeyPair(srvCert, srvKey)
+	if pairErr != nil {
+		t.Fatal(pairErr)
+	}
+	var clientCAs = x509.NewCertPool()
+	clientCAs.AddCert(ca)
+	var srv = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.ServerName + " " + r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	srv.TLS = &tls.Config{
+		Certificates: []tls.Certificate{srvPair},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+	srv.StartTLS()
+	defer srv.Close()
+
+	var get = func(conf upstreamTLSConf) (string, error) {
+		var tlsConf, confErr = conf.config()
+		if confErr != nil {
+			t.Fatal(confErr)
+		}
+		var bal = &balancer{service: "test"}
+		var transport = &http.Transport{DialTLS: dialUpstreamTLS(tlsConf, &net.Dialer{Timeout: time.Second}, bal)}
+		defer transport.CloseIdleConnections()
+		var resp, err = (&http.Client{Transport: transport}).Get(srv.URL)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		var body, _ = ioutil.ReadAll(resp.Body)
+		return string(body), nil
+	}
+
+	var conf = upstreamTLSConf{CA: caFile, ServerName: "api.partner.test", Cert: clientCert, Key: clientKey}
+	if body, err := get(conf); err != nil || body != "api.partner.test client" {
+		t.Errorf("got %q, %v; want the server name and client certificate seen by the upstream", body, err)
+	}
+
+	var noCA = conf
+	noCA.CA = ""
+	if _, err := get(noCA); err == nil {
+		t.Error("upstream certificate accepted without its CA")
+	}
+
+	var noName = conf
+	noName.ServerName = ""
+	if _, err := get(noName); err == nil {
+		t.Error("upstream certificate accepted for the IP it was dialed by")
+	}
+
+	var noClient = conf
+	noClient.Cert, noClient.Key = "", ""
+	if _, err := get(noClient); err == nil {
+		t.Error("request went through without a client certificate")
+	}
+}
+
+func TestUpstreamTLSMinVersion(t *testing.T) {
+	var conf, confErr = upstreamTLSConf{MinVersion: "1.3"}.config()
+	if confErr != nil || conf.MinVersion != tls.VersionTLS13 {
+		t.Errorf("got %v, %v; want TLS 1.3", conf, confErr)
+	}
+	if _, err := (upstreamTLSConf{MinVersion: "1.4"}).config(); err == nil {
+		t.Error("unknown TLS version accepted")
+	}
+}